@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var copyBufs = sync.Pool{New: func() interface{} { b := make([]byte, 32<<10); return &b }}
+
+// compressResponse compresses the body of rsp for the tunnel while it's read, unless it's compressed already,
+// the proxy decompresses it again.
+func compressResponse(rsp *http.Response, compression string) error {
+	if enc := rsp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return nil
+	}
+	sr, err := newStreamReader(rsp.Body, compression)
+	if err != nil {
+		return err
+	}
+	body, buf := rsp.Body, copyBufs.Get().(*[]byte)
+	sr.release = append(sr.release, func() { copyBufs.Put(buf) })
+	sr.next = func(w io.Writer) error {
+		n, err := body.Read(*buf)
+		if n > 0 {
+			if _, werr := w.Write((*buf)[:n]); werr != nil {
+				return werr
+			}
+		}
+		return err
+	}
+	rsp.Header.Set(util.TunnelEncodingHeader, compression)
+	streamResponse(rsp, sr)
+	return nil
+}
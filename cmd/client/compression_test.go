@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressResponse(t *testing.T) {
+	body := strings.Repeat("up{instance=\"host\"} 1\n", 10000)
+	rsp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		Header:        http.Header{"Content-Length": {"220000"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	assert.NoError(t, compressResponse(rsp, util.CompressionZstd))
+
+	// the body is chunked in the tunnel, as its compressed length isn't known up front
+	var tunnel bytes.Buffer
+	assert.NoError(t, rsp.Write(&tunnel))
+	tunnel.WriteString("HTTP/1.1 204 No Content\r\n\r\n")
+	br := bufio.NewReader(&tunnel)
+	got, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, util.CompressionZstd, got.Header.Get(util.TunnelEncodingHeader))
+	dr, err := util.NewDecompressReader(got.Body, got.Header.Get(util.TunnelEncodingHeader))
+	if assert.NoError(t, err) {
+		out, _ := ioutil.ReadAll(dr)
+		assert.Equal(t, body, string(out))
+	}
+	next, err := http.ReadResponse(br, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusNoContent, next.StatusCode)
+	}
+}
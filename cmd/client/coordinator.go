@@ -4,11 +4,11 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -18,20 +18,23 @@ import (
 	"github.com/hashicorp/yamux"
 	"github.com/pkg/errors"
 	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/common/version"
 )
 
+// tunnelDialTimeout limits dialing the endpoint of a CONNECT tunnel.
+const tunnelDialTimeout = 10 * time.Second
+
 type tunnel struct {
 	token   string
 	conn    net.Conn
 	session *yamux.Session
 }
 
-func connectServer(pxyAddr, token string) (*tunnel, error) {
+func connectServer(pxyAddr, token string, cfg *yamux.Config) (*tunnel, error) {
 	conn, err := net.Dial("tcp", pxyAddr)
 	if err != nil {
 		return nil, err
 	}
-	cfg := yamux.DefaultConfig()
 	session, err := yamux.Client(conn, cfg)
 	if err != nil {
 		return nil, err
@@ -63,27 +66,39 @@ type Coordinator struct {
 	token          string
 	tunnel         *tunnel
 	ctlConn        net.Conn
+	ticket         string        // resumption ticket issued by the proxy
+	leaseTTL       time.Duration // lifetime of registrations on the proxy, 0 if they don't expire
+	metadata       bool          // the proxy takes registrations with labels
+	compressions   []string      // of scrape bodies in the tunnel offered to the proxy
+	compression    string        // of scrape bodies in the tunnel picked by the proxy, guarded by mu
 	fqdn           string
-	processes      map[string]*url.URL
+	processes      map[string]*Endpoint
 	transport      http.RoundTripper
-	modifyResponse func(*http.Response) error
+	modifyResponse func(*http.Response, *Endpoint) error
+	muxConfig      *yamux.Config
 
-	mu sync.Mutex // guard processes update
+	mu sync.Mutex // guard processes update, ctlConn and the session settings of the proxy, and writes to ctlConn
 }
 
-func makeEndpointUrls(eps []Endpoint) (map[string]*url.URL, error) {
-	var processes = map[string]*url.URL{}
+func makeEndpoints(eps []Endpoint) (map[string]*Endpoint, error) {
+	var processes = map[string]*Endpoint{}
 	for i := range eps {
 		if _, ok := processes[eps[i].Name]; ok {
 			return nil, fmt.Errorf("duplicate Endpoint, name: %s", eps[i].Name)
 		}
-		processes[eps[i].Name] = eps[i].URL
+		if eps[i].ScrapeInterval > 0 && eps[i].ScrapeTimeout > eps[i].ScrapeInterval {
+			return nil, fmt.Errorf("scrape timeout %s of Endpoint %s exceeds its scrape interval %s", eps[i].ScrapeTimeout, eps[i].Name, eps[i].ScrapeInterval)
+		}
+		if err := eps[i].Forward.validate(); err != nil {
+			return nil, fmt.Errorf("invalid forward of Endpoint %s: %v", eps[i].Name, err)
+		}
+		processes[eps[i].Name] = &eps[i]
 	}
 	return processes, nil
 }
 
 func NewCoordinator(c *Config) (*Coordinator, error) {
-	processes, err := makeEndpointUrls(c.Eps)
+	processes, err := makeEndpoints(c.Eps)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +111,14 @@ func NewCoordinator(c *Config) (*Coordinator, error) {
 	if len(pxyAddrs) == 0 {
 		return nil, errors.New("proxy address must be specified")
 	}
+	muxConfig, err := c.Mux.YamuxConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid mux config")
+	}
+	compressions, err := util.ParseCompressions(c.TunnelCompression)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tunnel compression")
+	}
 
 	return &Coordinator{
 		lg:             c.logger,
@@ -105,12 +128,17 @@ func NewCoordinator(c *Config) (*Coordinator, error) {
 		processes:      processes,
 		transport:      ts,
 		modifyResponse: c.rspModifier,
+		muxConfig:      muxConfig,
+		compressions:   compressions,
 	}, nil
 }
 
 func (c *Coordinator) prepare() error {
 	var err error
-	c.tunnel, err = connectServer(c.proxyAddr, c.token)
+	if c.tunnel != nil {
+		c.tunnel.Close()
+	}
+	c.tunnel, err = connectServer(c.proxyAddr, c.token, c.muxConfig)
 	if err != nil {
 		return fmt.Errorf("err connectServe: %v", err)
 	}
@@ -120,7 +148,7 @@ func (c *Coordinator) prepare() error {
 		return fmt.Errorf("err open control stream: %v", err)
 	}
 	ts := time.Now().Unix()
-	newClientMsg, err := (&util.NewClientMessage{Fqdn: c.fqdn, Timestamp: ts, Auth: util.SignAuth(c.token, ts)}).Marshal()
+	newClientMsg, err := (&util.NewClientMessage{Fqdn: c.fqdn, Timestamp: ts, Auth: util.SignAuth(c.token, ts), Ticket: c.ticket, Leases: true, Version: version.Version, Compressions: c.compressions}).Marshal()
 	if err != nil {
 		ctlConn.Close()
 		return fmt.Errorf("err Marshal NewClientMessage: %v", err)
@@ -137,13 +165,24 @@ func (c *Coordinator) prepare() error {
 		return fmt.Errorf("err wrap conn as CryptoConn: %v", err)
 	}
 	ctlConn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	msgType, _, err := util.ReadMsg(ctlConn)
+	msgType, msg, err := util.ReadMsg(ctlConn)
 	if err != nil || msgType != util.MsgTypeNewMachineOK {
 		ctlConn.Close()
 		panic("err wait MsgTypeNewMachineOK, client auth failed, invalid token")
 	}
 	ctlConn.SetReadDeadline(time.Time{})
+	okMsg, err := util.UnmarshalIntoNewMachineOKMessage(msg)
+	if err != nil {
+		ctlConn.Close()
+		return fmt.Errorf("err Unmarshal NewMachineOKMessage: %v", err)
+	}
+	c.mu.Lock()
+	c.ticket = okMsg.Ticket
+	c.leaseTTL = time.Duration(okMsg.LeaseTTLSeconds) * time.Second
+	c.metadata = okMsg.RegisterMetadata
+	c.compression = okMsg.Compression
 	c.ctlConn = ctlConn
+	c.mu.Unlock()
 	return nil
 }
 
@@ -154,12 +193,22 @@ func (c *Coordinator) Start() {
 		return
 	}
 
-	for name := range c.processes {
-		err = util.WriteMsg(c.ctlConn, util.MsgTypeRegister, []byte(name))
-		if err != nil {
-			level.Error(c.lg).Log("msg", "send MsgTypeRegister", "err", err)
-			return
-		}
+	if err = c.sendAll(util.MsgTypeRegister); err != nil {
+		level.Error(c.lg).Log("msg", "send MsgTypeRegister", "err", err)
+		return
+	}
+	if c.leaseTTL > 0 {
+		done, renewing := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(renewing)
+			c.renewLeases(c.leaseTTL, done)
+		}()
+		// the renewals stop before the next prepare replaces the control connection
+		defer func() {
+			close(done)
+			c.ctlConn.Close()
+			<-renewing
+		}()
 	}
 
 	for {
@@ -188,11 +237,107 @@ func (c *Coordinator) Start() {
 	}
 }
 
+// sendAll sends a message of typ for every process on the control connection.
+func (c *Coordinator) sendAll(typ util.MsgType) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ep := range c.processes {
+		if err := util.WriteMsg(c.ctlConn, typ, c.registration(ep)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registration returns the payload registering ep, proxies not announcing metadata
+// support take the bare process name.
+func (c *Coordinator) registration(ep *Endpoint) []byte {
+	if !c.metadata {
+		return []byte(ep.Name)
+	}
+	b, err := (&util.RegisterMessage{Process: ep.Name, Labels: ep.registeredLabels()}).Marshal()
+	if err != nil {
+		return []byte(ep.Name)
+	}
+	return b
+}
+
+// renewLeases renews the registrations on the proxy well before their lease of ttl lapses,
+// until done is closed.
+func (c *Coordinator) renewLeases(ttl time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.sendAll(util.MsgTypeRenew); err != nil {
+				level.Error(c.lg).Log("msg", "send MsgTypeRenew", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// registeredLabels returns the labels of ep with its scrape settings and the path it's scraped at
+// under the names of the labels Prometheus takes them from.
+func (ep *Endpoint) registeredLabels() map[string]string {
+	if ep.Job == "" && ep.ScrapeInterval == 0 && ep.ScrapeTimeout == 0 && ep.URL.Path == "" {
+		return ep.Labels
+	}
+	labels := make(map[string]string, len(ep.Labels)+4)
+	for k, v := range ep.Labels {
+		labels[k] = v
+	}
+	if ep.Job != "" {
+		labels["job"] = ep.Job
+	}
+	if ep.ScrapeInterval > 0 {
+		labels["__scrape_interval__"] = ep.ScrapeInterval.String()
+	}
+	if ep.ScrapeTimeout > 0 {
+		labels["__scrape_timeout__"] = ep.ScrapeTimeout.String()
+	}
+	if ep.URL.Path != "" {
+		labels["__metrics_path__"] = ep.URL.Path
+	}
+	return labels
+}
+
 func (c *Coordinator) handleScrape(scon net.Conn) {
+	br := bufio.NewReader(scon)
+	// Requests are read ahead, so that the proxy closing the connection while a scrape is in flight,
+	// as Prometheus gave up on it, is noticed and aborts the scrape. Scrape requests carry no body.
+	requests, closed, done := make(chan *http.Request), make(chan struct{}), make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(closed)
+		for {
+			request, err := http.ReadRequest(br)
+			if err != nil {
+				if err != io.EOF {
+					level.Error(c.lg).Log("msg", "read scrape request", "err", err)
+				}
+				return
+			}
+			select {
+			case requests <- request:
+			case <-done:
+				return
+			}
+			if request.Method == http.MethodConnect {
+				return
+			}
+		}
+	}()
+
 	for {
-		request, err := http.ReadRequest(bufio.NewReader(scon))
-		if err != nil {
-			level.Error(c.lg).Log("msg", "read scrape request", "err", err)
+		var request *http.Request
+		select {
+		case request = <-requests:
+		case <-closed:
 			scon.Close()
 			return
 		}
@@ -213,23 +358,44 @@ func (c *Coordinator) handleScrape(scon net.Conn) {
 			continue
 		}
 		var process = parts[0]
+		c.mu.Lock()
 		target, exist := c.processes[process]
+		compression := c.compression
+		c.mu.Unlock()
 		if !exist {
 			c.handleErr(scon, request, errors.New("scrape target doesn't match client process name"))
 			continue
 		}
+		if request.Method == http.MethodConnect {
+			// the scrape connection carries the tunnel to the endpoint until either side closes it
+			c.handleTunnel(scon, br, request, target)
+			return
+		}
 
 		timeout, err := util.GetHeaderTimeout(request.Header)
 		if err != nil {
 			c.handleErr(scon, request, err)
 			continue
 		}
+		targetURL, err := target.targetURL(request.URL)
+		if err != nil {
+			c.handleErrCode(scon, request, http.StatusForbidden, err)
+			continue
+		}
 
 		func() {
 			ctx, cancel := context.WithTimeout(request.Context(), timeout)
 			defer cancel()
+			go func() {
+				select {
+				case <-closed:
+					level.Debug(c.lg).Log("msg", "scrape canceled by the proxy", "process", process)
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
 			request = request.WithContext(ctx)
-			request.URL = target
+			request.URL = targetURL
 			scrapeResp, err := c.transport.RoundTrip(request)
 			if err != nil {
 				msg := fmt.Sprintf("failed to scrape %s", request.URL.String())
@@ -237,14 +403,28 @@ func (c *Coordinator) handleScrape(scon net.Conn) {
 				return
 			}
 			if scrapeResp.StatusCode == http.StatusOK && c.modifyResponse != nil {
-				err = c.modifyResponse(scrapeResp)
+				err = c.modifyResponse(scrapeResp, target)
 				if err != nil {
+					scrapeResp.Body.Close()
+					level.Warn(c.lg).Log("msg", "malformed scrape response", "process", process, "err", err)
 					msg := fmt.Sprintf("failed to mutate scraped response, process: %s", process)
 					c.handleErr(scon, request, errors.Wrap(err, msg))
 					return
 				}
 			}
+			if compression != "" {
+				if err = compressResponse(scrapeResp, compression); err != nil {
+					c.handleErr(scon, request, errors.Wrap(err, "failed to compress scraped response"))
+					return
+				}
+			}
 			err = scrapeResp.Write(scon)
+			var serr *streamError
+			if errors.As(err, &serr) {
+				level.Warn(c.lg).Log("msg", "malformed scrape response, aborted while it was sent", "process", process, "err", serr.err)
+				scon.Close()
+				return
+			}
 			if err != nil {
 				level.Error(c.lg).Log("msg", "write scrape result", "err", err)
 				scon.Close()
@@ -254,9 +434,47 @@ func (c *Coordinator) handleScrape(scon net.Conn) {
 	}
 }
 
+// handleTunnel pipes the CONNECT tunnel on scon to the https endpoint target, TLS is terminated by the endpoint.
+func (c *Coordinator) handleTunnel(scon net.Conn, br *bufio.Reader, request *http.Request, target *Endpoint) {
+	defer scon.Close()
+	if target.URL.Scheme != "https" {
+		c.handleErr(scon, request, fmt.Errorf("endpoint %s isn't https", target.URL.Redacted()))
+		return
+	}
+	addr := target.URL.Host
+	if target.URL.Port() == "" {
+		addr = net.JoinHostPort(target.URL.Hostname(), "443")
+	}
+	conn, err := net.DialTimeout("tcp", addr, tunnelDialTimeout)
+	if err != nil {
+		rsp := http.Response{StatusCode: http.StatusBadGateway, ProtoMajor: 1, ProtoMinor: 1, Body: http.NoBody}
+		rsp.Write(scon)
+		level.Error(c.lg).Log("msg", "dial tunnel", "addr", addr, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(scon, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, br)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(scon, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
 func (c *Coordinator) handleErr(scon net.Conn, request *http.Request, err error) {
+	c.handleErrCode(scon, request, http.StatusInternalServerError, err)
+}
+
+func (c *Coordinator) handleErrCode(scon net.Conn, request *http.Request, code int, err error) {
 	rsp := http.Response{}
-	rsp.StatusCode = http.StatusInternalServerError
+	rsp.StatusCode = code
 	errMsg := err.Error()
 	rsp.Body = ioutil.NopCloser(strings.NewReader(errMsg))
 	rsp.ContentLength = int64(len([]byte(errMsg)))
@@ -264,7 +482,7 @@ func (c *Coordinator) handleErr(scon net.Conn, request *http.Request, err error)
 }
 
 func (c *Coordinator) Update(eps []Endpoint) error {
-	processes, err := makeEndpointUrls(eps)
+	processes, err := makeEndpoints(eps)
 	if err != nil {
 		return err
 	}
@@ -274,7 +492,7 @@ func (c *Coordinator) Update(eps []Endpoint) error {
 
 	// deregister old processes
 	for name := range c.processes {
-		err = util.WriteMsg(c.tunnel.conn, util.MsgTypeDeregister, []byte(name))
+		err = util.WriteMsg(c.ctlConn, util.MsgTypeDeregister, []byte(name))
 		if err != nil {
 			level.Error(c.lg).Log("msg", "send MsgTypeDeregister", "err", err)
 			return err
@@ -282,8 +500,8 @@ func (c *Coordinator) Update(eps []Endpoint) error {
 	}
 	// register updated processes
 	c.processes = processes
-	for name := range c.processes {
-		err = util.WriteMsg(c.tunnel.conn, util.MsgTypeRegister, []byte(name))
+	for _, ep := range c.processes {
+		err = util.WriteMsg(c.ctlConn, util.MsgTypeRegister, c.registration(ep))
 		if err != nil {
 			level.Error(c.lg).Log("msg", "send MsgTypeRegister", "err", err)
 			return err
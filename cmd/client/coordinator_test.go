@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/yamux"
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeCanceledByProxy(t *testing.T) {
+	scraped, aborted := make(chan struct{}), make(chan struct{})
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(scraped)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer exporter.Close()
+	URL, _ := url.Parse(exporter.URL + "/metrics")
+
+	c := &Coordinator{
+		lg:        log.NewNopLogger(),
+		fqdn:      "client",
+		processes: map[string]*Endpoint{"node": {Name: "node", URL: URL}},
+		transport: http.DefaultTransport,
+	}
+	proxy, scon := net.Pipe()
+	go c.handleScrape(scon)
+
+	req, _ := http.NewRequest("GET", "http://node.client:80/metrics", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "30")
+	go req.Write(proxy)
+	<-scraped
+
+	// the proxy closes the scrape connection as Prometheus gave up
+	proxy.Close()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape of the exporter wasn't aborted")
+	}
+}
+
+func TestScrapeMalformed(t *testing.T) {
+	body := "up 1\n"
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer exporter.Close()
+	URL, _ := url.Parse(exporter.URL + "/metrics")
+
+	c := &Coordinator{
+		lg:             log.NewNopLogger(),
+		fqdn:           "client",
+		processes:      map[string]*Endpoint{"node": {Name: "node", URL: URL}},
+		transport:      http.DefaultTransport,
+		modifyResponse: newMetricModifier(map[string]string{"cluster": "a"}, nil).injectLabelParis,
+	}
+	scrape := func() (*http.Response, string) {
+		proxy, scon := net.Pipe()
+		defer proxy.Close()
+		go c.handleScrape(scon)
+		req, _ := http.NewRequest("GET", "http://node.client:80/metrics", nil)
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "30")
+		go req.Write(proxy)
+		rsp, err := http.ReadResponse(bufio.NewReader(proxy), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := ioutil.ReadAll(rsp.Body)
+		return rsp, string(out)
+	}
+
+	rsp, out := scrape()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "up{cluster=\"a\"} 1\n", out)
+
+	body = "up 1\nup{instance=\"x} 1\n"
+	rsp, out = scrape()
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	assert.Contains(t, out, `unterminated label value in "up{instance=\"x} 1"`)
+}
+
+func TestRegisteredLabels(t *testing.T) {
+	URL, _ := url.Parse("http://127.0.0.1:9115/probe")
+	ep := &Endpoint{Name: "blackbox", URL: URL, Labels: map[string]string{"team": "infra"}, Job: "blackbox", ScrapeTimeout: model.Duration(10 * time.Second)}
+	assert.Equal(t, map[string]string{"team": "infra", "job": "blackbox", "__scrape_timeout__": "10s", "__metrics_path__": "/probe"}, ep.registeredLabels())
+
+	URL, _ = url.Parse("http://127.0.0.1:9100")
+	ep = &Endpoint{Name: "node", URL: URL}
+	assert.Nil(t, ep.registeredLabels())
+}
+
+// TestReconnect runs the client against a proxy dropping the session once the leases were
+// renewed, run it with -race.
+func TestReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	renewed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				session, err := yamux.Server(conn, nil)
+				if err != nil {
+					return
+				}
+				defer session.Close()
+				stream, err := session.Accept()
+				if err != nil {
+					return
+				}
+				if _, _, err = util.ReadMsg(stream); err != nil {
+					return
+				}
+				ctlConn, _ := util.WrapAsCryptoConn(stream, []byte("token"))
+				okMsg, _ := (&util.NewMachineOKMessage{Ticket: "ticket", LeaseTTLSeconds: 1}).Marshal()
+				if err = util.WriteMsg(ctlConn, util.MsgTypeNewMachineOK, okMsg); err != nil {
+					return
+				}
+				for {
+					typ, _, err := util.ReadMsg(ctlConn)
+					if err != nil {
+						return
+					}
+					if typ == util.MsgTypeRenew {
+						renewed <- struct{}{}
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	URL, _ := url.Parse("http://127.0.0.1:9100/metrics")
+	c := &Coordinator{
+		lg:        log.NewNopLogger(),
+		proxyAddr: l.Addr().String(),
+		token:     "token",
+		fqdn:      "client",
+		processes: map[string]*Endpoint{"node": {Name: "node", URL: URL}},
+		transport: http.DefaultTransport,
+	}
+	for i := 0; i < 2; i++ {
+		c.Start()
+		select {
+		case <-renewed:
+		default:
+			t.Fatal("session ended before the leases were renewed")
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// bufReaderSize is the buffer of the readers of scrape bodies, lines longer than it are copied aside.
+const bufReaderSize = 64 << 10
+
+// The (de)compressors are pooled as they allocate their windows and tables, a zstd encoder a few MB.
+var (
+	bufReaders  sync.Pool
+	gzipReaders sync.Pool
+	zlibReaders sync.Pool
+	zstdReaders sync.Pool
+	gzipWriters sync.Pool
+	zlibWriters sync.Pool
+	zstdWriters sync.Pool
+)
+
+func getBufReader(r io.Reader) *bufio.Reader {
+	if br, ok := bufReaders.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, bufReaderSize)
+}
+
+func putBufReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufReaders.Put(br)
+}
+
+// decodeBody returns a reader decompressing r by the Content-Encoding encoding, and a func to release it.
+func decodeBody(r io.Reader, encoding string) (io.Reader, func(), error) {
+	switch encoding {
+	case "", "identity":
+		return r, func() {}, nil
+	case "gzip":
+		zr, ok := gzipReaders.Get().(*gzip.Reader)
+		if !ok {
+			zr = new(gzip.Reader)
+		}
+		if err := zr.Reset(r); err != nil {
+			gzipReaders.Put(zr)
+			return nil, nil, err
+		}
+		return zr, func() { gzipReaders.Put(zr) }, nil
+	case "deflate":
+		// deflate in HTTP is the zlib format
+		zr, ok := zlibReaders.Get().(io.ReadCloser)
+		if ok {
+			if err := zr.(zlib.Resetter).Reset(r, nil); err != nil {
+				zlibReaders.Put(zr)
+				return nil, nil, err
+			}
+		} else {
+			var err error
+			if zr, err = zlib.NewReader(r); err != nil {
+				return nil, nil, err
+			}
+		}
+		return zr, func() { zlibReaders.Put(zr) }, nil
+	case "zstd":
+		d, ok := zstdReaders.Get().(*zstd.Decoder)
+		if !ok {
+			var err error
+			if d, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := d.Reset(r); err != nil {
+			zstdReaders.Put(d)
+			return nil, nil, err
+		}
+		return d, func() {
+			d.Reset(nil)
+			zstdReaders.Put(d)
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// encodeBody returns a writer compressing into w by the Content-Encoding encoding, and a func to release it.
+// The writer is nil for the identity encoding.
+func encodeBody(w io.Writer, encoding string) (io.WriteCloser, func(), error) {
+	switch encoding {
+	case "", "identity":
+		return nil, func() {}, nil
+	case "gzip":
+		zw, ok := gzipWriters.Get().(*gzip.Writer)
+		if ok {
+			zw.Reset(w)
+		} else {
+			zw = gzip.NewWriter(w)
+		}
+		return zw, func() { gzipWriters.Put(zw) }, nil
+	case "deflate":
+		zw, ok := zlibWriters.Get().(*zlib.Writer)
+		if ok {
+			zw.Reset(w)
+		} else {
+			zw = zlib.NewWriter(w)
+		}
+		return zw, func() { zlibWriters.Put(zw) }, nil
+	case "zstd":
+		e, ok := zstdWriters.Get().(*zstd.Encoder)
+		if ok {
+			e.Reset(w)
+		} else {
+			var err error
+			if e, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true)); err != nil {
+				return nil, nil, err
+			}
+		}
+		return e, func() {
+			e.Reset(nil)
+			zstdWriters.Put(e)
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// streamReader produces a scrape body while it's read. next writes the next part of the body, i.e. a line,
+// to w, the encoder of the body, and returns io.EOF after the last part. The encoded output is buffered until
+// it's read, so the memory held is bounded by a part and the encoder, whatever the size of the body.
+type streamReader struct {
+	next    func(w io.Writer) error
+	w       io.Writer
+	body    io.Closer
+	enc     io.WriteCloser
+	out     bytes.Buffer
+	release []func()
+	err     error
+}
+
+// newStreamReader returns a streamReader of body encoded by the Content-Encoding encoding, its next must be set.
+func newStreamReader(body io.Closer, encoding string) (*streamReader, error) {
+	sr := &streamReader{body: body}
+	enc, release, err := encodeBody(&sr.out, encoding)
+	if err != nil {
+		return nil, err
+	}
+	sr.w, sr.enc, sr.release = &sr.out, enc, []func(){release}
+	if enc != nil {
+		sr.w = enc
+	}
+	return sr, nil
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for sr.out.Len() == 0 && sr.err == nil {
+		sr.advance(sr.w)
+	}
+	if sr.out.Len() > 0 {
+		return sr.out.Read(p)
+	}
+	return 0, sr.err
+}
+
+// prime produces the body until n bytes of it, before encoding, are buffered or it ends, so that a body
+// malformed early fails before the response is on its way. Most bodies fit.
+func (sr *streamReader) prime(n int) error {
+	cw := &countingWriter{w: sr.w}
+	for cw.n < n && sr.err == nil {
+		sr.advance(cw)
+	}
+	if sr.err != nil && sr.err != io.EOF {
+		return sr.err.(*streamError).err
+	}
+	return nil
+}
+
+func (sr *streamReader) advance(w io.Writer) {
+	err := sr.next(w)
+	if err == io.EOF && sr.enc != nil {
+		err = sr.enc.Close()
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	if err != nil && err != io.EOF {
+		err = &streamError{err: err}
+	}
+	sr.err = err
+}
+
+// streamError is an error producing a body while it's read, the response is already on its way.
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string { return e.err.Error() }
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// Close closes the body and releases the (de)compressors, the streamReader mustn't be read any more.
+func (sr *streamReader) Close() error {
+	if sr.err == http.ErrBodyReadAfterClose {
+		return nil
+	}
+	sr.err = http.ErrBodyReadAfterClose
+	sr.out.Reset()
+	for _, release := range sr.release {
+		release()
+	}
+	return sr.body.Close()
+}
+
+// streamResponse replaces the body of rsp by sr, of unknown length, it's written chunked.
+func streamResponse(rsp *http.Response, sr *streamReader) {
+	rsp.Body = sr
+	rsp.ContentLength = -1
+	rsp.Header.Del("Content-Length")
+	rsp.TransferEncoding = []string{"chunked"}
+	// HTTP/1.0 has no chunked encoding
+	rsp.Proto, rsp.ProtoMajor, rsp.ProtoMinor = "HTTP/1.1", 1, 1
+}
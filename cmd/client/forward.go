@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// defaultMetricsPath is the metrics_path of Prometheus jobs that don't set one.
+const defaultMetricsPath = "/metrics"
+
+// Forward passes the query string and path of scrapes through to the endpoint, as needed by
+// multi-target exporters like blackbox_exporter and snmp_exporter or /federate?match[]=.
+type Forward struct {
+	// Query forwards the query string of the scrape
+	Query bool `yaml:"query,omitempty"`
+	// Path scrapes the path of the scrape in place of the path of the endpoint if it is below the path
+	// of the endpoint or AllowedPaths, except for the default metrics path of Prometheus, which scrapes
+	// the endpoint as is
+	Path bool `yaml:"path,omitempty"`
+	// AllowedParams restricts the names of forwarded query parameters, any name is allowed if empty
+	AllowedParams []string `yaml:"allowed_params,omitempty"`
+	// AllowedPaths are prefixes of forwarded paths allowed besides the path of the endpoint
+	AllowedPaths []string `yaml:"allowed_paths,omitempty"`
+}
+
+func (f *Forward) validate() error {
+	for _, prefix := range f.AllowedPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("allowed path %q doesn't start with /", prefix)
+		}
+	}
+	return nil
+}
+
+// targetURL returns the url to scrape the endpoint for a scrape of u. Parameters of the
+// endpoint url are overridden by forwarded ones, which are overridden by the fixed Params.
+func (ep *Endpoint) targetURL(u *url.URL) (*url.URL, error) {
+	target := *ep.URL
+	query := target.Query()
+
+	if p := path.Clean("/" + u.Path); ep.Forward.Path && p != "/" && p != defaultMetricsPath {
+		if !allowedPath(path.Clean("/"+target.Path), ep.Forward.AllowedPaths, p) {
+			return nil, fmt.Errorf("path %q isn't allowed", p)
+		}
+		target.Path, target.RawPath = p, ""
+	}
+	if ep.Forward.Query {
+		for name, values := range u.Query() {
+			if !allowedParam(ep.Forward.AllowedParams, name) {
+				return nil, fmt.Errorf("parameter %q isn't allowed", name)
+			}
+			query[name] = values
+		}
+	}
+	for name, values := range ep.Params {
+		query[name] = values
+	}
+	target.RawQuery = query.Encode()
+	return &target, nil
+}
+
+func allowedParam(allowed []string, name string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedPath reports whether p is below base, the path of the endpoint, or one of the prefixes,
+// matching whole path segments.
+func allowedPath(base string, prefixes []string, p string) bool {
+	for _, prefix := range append([]string{base}, prefixes...) {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
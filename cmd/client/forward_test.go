@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestTargetURL(t *testing.T) {
+	var eps []Endpoint
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+- url: http://127.0.0.1:9100/metrics?collect=cpu
+  name: node
+- url: http://127.0.0.1:9115/probe
+  name: blackbox
+  params:
+    module: [http_2xx]
+  forward:
+    query: true
+    allowed_params: [target, module]
+- url: http://127.0.0.1:9090/metrics
+  name: prometheus
+  forward:
+    query: true
+    path: true
+    allowed_paths: [/federate, /api/v1/]
+- url: http://127.0.0.1:9116/snmp
+  name: snmp
+  forward:
+    query: true
+    path: true
+    allowed_paths: [/snmp/v2]
+- url: http://127.0.0.1:9200/exporter/metrics
+  name: exporter
+  forward:
+    path: true
+`), &eps))
+	processes, err := makeEndpoints(eps)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, tc := range []struct {
+		process, scrape, want, err string
+	}{
+		{process: "node", scrape: "/other?x=1", want: "http://127.0.0.1:9100/metrics?collect=cpu"},
+		{process: "blackbox", scrape: "/?target=example.com&module=icmp", want: "http://127.0.0.1:9115/probe?module=http_2xx&target=example.com"},
+		{process: "blackbox", scrape: "/?debug=true", err: `parameter "debug" isn't allowed`},
+		{process: "prometheus", scrape: "/federate?match%5B%5D=up", want: "http://127.0.0.1:9090/federate?match%5B%5D=up"},
+		{process: "prometheus", scrape: "/api/v1/query", want: "http://127.0.0.1:9090/api/v1/query"},
+		{process: "prometheus", scrape: "/metrics", want: "http://127.0.0.1:9090/metrics"},
+		{process: "prometheus", scrape: "/", want: "http://127.0.0.1:9090/metrics"},
+		// the default metrics path of Prometheus isn't appended to the path of the endpoint
+		{process: "snmp", scrape: "/metrics?target=switch", want: "http://127.0.0.1:9116/snmp?target=switch"},
+		{process: "snmp", scrape: "/snmp/v2?target=switch", want: "http://127.0.0.1:9116/snmp/v2?target=switch"},
+		// the path registered as __metrics_path__
+		{process: "snmp", scrape: "/snmp?target=switch", want: "http://127.0.0.1:9116/snmp?target=switch"},
+		{process: "prometheus", scrape: "/federatex", err: `path "/federatex" isn't allowed`},
+		{process: "prometheus", scrape: "/federate/../admin", err: `path "/admin" isn't allowed`},
+		// without allowed_paths only paths below the path of the endpoint are forwarded
+		{process: "exporter", scrape: "/exporter/metrics/node", want: "http://127.0.0.1:9200/exporter/metrics/node"},
+		{process: "exporter", scrape: "/exporter/metrics", want: "http://127.0.0.1:9200/exporter/metrics"},
+		{process: "exporter", scrape: "/../admin", err: `path "/admin" isn't allowed`},
+		{process: "exporter", scrape: "/exporter/metrics/../admin", err: `path "/exporter/admin" isn't allowed`},
+		{process: "exporter", scrape: "/exporter/metricsx", err: `path "/exporter/metricsx" isn't allowed`},
+		{process: "exporter", scrape: "/debug/pprof", err: `path "/debug/pprof" isn't allowed`},
+		{process: "snmp", scrape: "/snmp/v3?target=switch", want: "http://127.0.0.1:9116/snmp/v3?target=switch"},
+	} {
+		u, _ := url.Parse(tc.scrape)
+		got, err := processes[tc.process].targetURL(u)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.scrape)
+			continue
+		}
+		if assert.NoError(t, err, tc.scrape) {
+			assert.Equal(t, tc.want, got.String(), tc.scrape)
+		}
+	}
+
+	_, err = makeEndpoints([]Endpoint{{Name: "x", URL: &url.URL{}, Forward: Forward{AllowedPaths: []string{"federate"}}}})
+	assert.Error(t, err)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,6 +14,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -27,12 +27,55 @@ var (
 	myFqdn          = kingpin.Flag("fqdn", "FQDN to register with").String()
 	metricEndpoints = kingpin.Flag("metrics", "Metric endpoints of processes wait for scraping(http://127.1:8999/metrics,http://127.0.0.1:8900/metrics), multiple endpoints are split by comma.").String()
 	labelPairs      = kingpin.Flag("label-pairs", "Label pairs add to prometheus metrics if not specified(i.e node=my-node,region=shanghai)").String()
+	namingStrategy  = kingpin.Flag("naming.strategy", "How endpoints without a name are named: base64 of host and path, template or hash, a short hash of the url.").Default(NamingBase64).Enum(NamingBase64, NamingTemplate, NamingHash)
+	namingTemplate  = kingpin.Flag("naming.template", "Template naming endpoints for the template strategy, placeholders are {{scheme}}, {{host}}, {{hostname}}, {{port}} and {{path}}.").Default(defaultNamingTemplate).String()
+	tunnelCompress  = kingpin.Flag("tunnel.compression", "Compressions of scrape bodies in the tunnel offered to the proxy in order of preference, zstd and gzip, comma separated or none.").Default("zstd,gzip").String()
 	configFile      = kingpin.Flag("config", "Config file of proxy client, arguments in file takes priority over command arguments(i.e ./pushproxc.yaml").Short('f').String()
+
+	muxConfig util.MuxConfig
 )
 
 type Endpoint struct {
 	Name string   `yaml:"name,omitempty"`
 	URL  *url.URL `yaml:"url"`
+	// Labels are registered with the process and exposed by the proxy as __meta_pushprox_label_<name>
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Job, ScrapeInterval and ScrapeTimeout are registered with the process for service discovery,
+	// the proxy clamps scrapes of the process to ScrapeTimeout
+	Job            string         `yaml:"job,omitempty"`
+	ScrapeInterval model.Duration `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  model.Duration `yaml:"scrape_timeout,omitempty"`
+	// Params are fixed query parameters of scrapes, they override forwarded ones
+	Params  url.Values `yaml:"params,omitempty"`
+	Forward Forward    `yaml:"forward,omitempty"`
+	// MetricRelabelConfigs relabel the samples of the endpoint after the global ones
+	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, the url is given as string.
+func (e *Endpoint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		Name           string            `yaml:"name,omitempty"`
+		URL            string            `yaml:"url"`
+		Labels         map[string]string `yaml:"labels,omitempty"`
+		Job            string            `yaml:"job,omitempty"`
+		ScrapeInterval model.Duration    `yaml:"scrape_interval,omitempty"`
+		ScrapeTimeout  model.Duration    `yaml:"scrape_timeout,omitempty"`
+		Params         url.Values        `yaml:"params,omitempty"`
+		Forward        Forward           `yaml:"forward,omitempty"`
+		Relabel        []*RelabelConfig  `yaml:"metric_relabel_configs,omitempty"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	URL, err := url.Parse(raw.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url of endpoint %q: %v", raw.Name, err)
+	}
+	e.Name, e.URL, e.Labels = raw.Name, URL, raw.Labels
+	e.Job, e.ScrapeInterval, e.ScrapeTimeout = raw.Job, raw.ScrapeInterval, raw.ScrapeTimeout
+	e.Params, e.Forward, e.MetricRelabelConfigs = raw.Params, raw.Forward, raw.Relabel
+	return nil
 }
 
 type Config struct {
@@ -45,13 +88,21 @@ type Config struct {
 	Eps []Endpoint `yaml:"metrics"`
 	// LabelPairs add to prometheus metrics if not specified(i.e node=my-node,region=shanghai)
 	LabelPairs map[string]string `yaml:"label-pairs,omitempty"`
+	// MetricRelabelConfigs relabel the samples of all endpoints after LabelPairs are added, before the tunnel
+	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs,omitempty"`
+	// Naming names the endpoints without an explicit name
+	Naming Naming `yaml:"naming,omitempty"`
+	// TunnelCompression are the compressions of scrape bodies in the tunnel offered to the proxy(i.e zstd,gzip)
+	TunnelCompression string `yaml:"tunnel-compression,omitempty"`
+	// Mux tunes the yamux session to the proxy, i.e window size and keepalive for high-latency links
+	Mux util.MuxConfig `yaml:"mux,omitempty"`
 
 	transport   http.RoundTripper
-	rspModifier func(*http.Response) error
+	rspModifier func(*http.Response, *Endpoint) error
 	logger      log.Logger
 }
 
-func (c *Config) complete() {
+func (c *Config) complete() error {
 	if c.FQDN == "" {
 		FQDN, err := fqdn.FqdnHostname()
 		if err != nil {
@@ -59,17 +110,16 @@ func (c *Config) complete() {
 		}
 		c.FQDN = FQDN
 	}
-	for i := range c.Eps {
-		if c.Eps[i].Name == "" {
-			c.Eps[i].Name = base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s%s", c.Eps[i].URL.Host, c.Eps[i].URL.Path)))
-		}
-	}
+	return nameEndpoints(c.Eps, &c.Naming)
 }
 
 func mustLoadConf() *Config {
 	var conf Config
 	conf.ProxyAddr = *proxyAddr
 	conf.Token = *authToken
+	conf.Mux = muxConfig
+	conf.TunnelCompression = *tunnelCompress
+	conf.Naming = Naming{Strategy: *namingStrategy, Template: *namingTemplate}
 	if *myFqdn != "" {
 		conf.FQDN = *myFqdn
 	}
@@ -110,16 +160,38 @@ func mustLoadConf() *Config {
 func main() {
 	promlogConfig := promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, &promlogConfig)
+	util.AddMuxFlags(kingpin.CommandLine, &muxConfig)
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 	lg := promlog.New(&promlogConfig)
 	kingpin.Parse()
 	kingpin.Parse()
 	var conf = mustLoadConf()
-	conf.complete()
+	var unnamed bool
+	explicit := map[string]bool{}
+	for _, ep := range conf.Eps {
+		unnamed = unnamed || ep.Name == ""
+		explicit[ep.Name] = ep.Name != ""
+	}
+	if err := conf.complete(); err != nil {
+		level.Error(lg).Log("msg", "invalid config", "err", err)
+		os.Exit(1)
+	}
+	if unnamed && (conf.Naming.Strategy == "" || conf.Naming.Strategy == NamingBase64) {
+		level.Warn(lg).Log("msg", "endpoints without a name are named base64 of host and path, which isn't a valid DNS label, consider --naming.strategy=template")
+	}
+	for _, ep := range conf.Eps {
+		if explicit[ep.Name] && !isDNSLabel(ep.Name) {
+			level.Warn(lg).Log("msg", "endpoint name isn't a valid DNS label, it can't be scraped as a subdomain or by the DNS of the proxy", "name", ep.Name, "url", ep.URL)
+		}
+	}
 
-	if len(conf.LabelPairs) > 0 {
-		conf.rspModifier = (&metricModifier{addonLabelPairs: conf.LabelPairs}).injectLabelParis
+	relabel := len(conf.MetricRelabelConfigs) > 0
+	for _, ep := range conf.Eps {
+		relabel = relabel || len(ep.MetricRelabelConfigs) > 0
+	}
+	if len(conf.LabelPairs) > 0 || relabel {
+		conf.rspModifier = newMetricModifier(conf.LabelPairs, conf.MetricRelabelConfigs).injectLabelParis
 	}
 	conf.logger = log.With(lg, "from", "Coordinator")
 
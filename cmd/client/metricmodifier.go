@@ -1,79 +1,128 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/golang/protobuf/proto"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 type metricModifier struct {
 	addonLabelPairs map[string]string
+	// labels are the addon label pairs rendered for the text formats, sorted by name
+	labels []renderedLabel
+	// relabelConfigs relabel the samples of all endpoints, before the ones of the endpoint
+	relabelConfigs []*RelabelConfig
 }
 
-func (mh *metricModifier) injectLabelParis(rsp *http.Response) error {
-	var err error
-	var inputMetrics []byte
-	var reader io.ReadCloser
-	var isGzip bool
-
-	switch rsp.Header.Get("Content-Encoding") {
-	case "gzip":
-		reader, err = gzip.NewReader(rsp.Body)
-		isGzip = true
-	default:
-		reader = rsp.Body
+type renderedLabel struct {
+	name, pair []byte
+	value      string
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func newMetricModifier(pairs map[string]string, relabelConfigs []*RelabelConfig) *metricModifier {
+	mh := &metricModifier{addonLabelPairs: pairs, relabelConfigs: relabelConfigs}
+	for name, value := range pairs {
+		mh.labels = append(mh.labels, renderedLabel{
+			name:  []byte(name),
+			pair:  []byte(name + `="` + labelValueEscaper.Replace(value) + `"`),
+			value: value,
+		})
 	}
-	defer reader.Close()
-	if inputMetrics, err = ioutil.ReadAll(reader); err != nil {
+	sort.Slice(mh.labels, func(i, j int) bool { return bytes.Compare(mh.labels[i].name, mh.labels[j].name) < 0 })
+	return mh
+}
+
+// injectLabelParis adds the addon label pairs to the metrics of rsp while its body is read, keeping its
+// exposition format and Content-Encoding. Text and OpenMetrics are rewritten line by line, so exemplars and
+// _created samples are kept as they are, protobuf is decoded and encoded again by metric family, keeping
+// native histograms. The samples are relabeled by the metric_relabel_configs afterwards, globally and of ep.
+// A body malformed in its first bufReaderSize bytes fails injectLabelParis, later on it fails reading the body.
+func (mh *metricModifier) injectLabelParis(rsp *http.Response, ep *Endpoint) error {
+	format := responseFormat(rsp.Header)
+	if format == expfmt.FmtUnknown {
+		return fmt.Errorf("unsupported exposition format %q", rsp.Header.Get("Content-Type"))
+	}
+	encoding := rsp.Header.Get("Content-Encoding")
+	input, release, err := decodeBody(rsp.Body, encoding)
+	if err != nil {
 		return err
 	}
-
-	// enforce label pairs for prom metrics
-	metrics, err := decodeMetric(bytes.NewReader(inputMetrics), expfmt.FmtText)
+	sr, err := newStreamReader(rsp.Body, encoding)
 	if err != nil {
+		release()
 		return err
 	}
-
-	appendLabelPairIfAbsent(metrics, mh.addonLabelPairs)
-
-	var newMets bytes.Buffer
-	var w io.Writer = &newMets
-	if isGzip {
-		w = gzip.NewWriter(&newMets)
+	br := getBufReader(input)
+	sr.release = append(sr.release, func() { putBufReader(br) }, release)
+	relabelConfigs := mh.relabelConfigs
+	if ep != nil && len(ep.MetricRelabelConfigs) > 0 {
+		relabelConfigs = append(relabelConfigs[:len(relabelConfigs):len(relabelConfigs)], ep.MetricRelabelConfigs...)
+	}
+	var r *relabeler
+	if len(relabelConfigs) > 0 {
+		r = &relabeler{cfgs: relabelConfigs}
 	}
-	metricEnc := expfmt.NewEncoder(w, expfmt.FmtText)
-	for i := range metrics {
-		err = metricEnc.Encode(metrics[i])
-		if err != nil {
-			return err
+
+	switch format {
+	case expfmt.FmtProtoDelim:
+		dec := expfmt.NewDecoder(br, format)
+		sr.next = func(w io.Writer) error {
+			var mf clientmodel.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				return err
+			}
+			// enforce label pairs for prom metrics
+			appendLabelPairIfAbsent([]*clientmodel.MetricFamily{&mf}, mh.addonLabelPairs)
+			enc := expfmt.NewEncoder(w, format)
+			if r == nil {
+				return enc.Encode(&mf)
+			}
+			for _, relabeled := range relabelFamily(&mf, r) {
+				if err := enc.Encode(relabeled); err != nil {
+					return err
+				}
+			}
+			return nil
 		}
+	default:
+		sr.next = (&textInjector{br: br, labels: mh.labels, relabeler: r}).next
 	}
-	if gw, ok := w.(io.WriteCloser); ok {
-		gw.Close()
+	if err := sr.prime(bufReaderSize); err != nil {
+		sr.Close()
+		return err
 	}
-
-	rsp.Body = ioutil.NopCloser(&newMets)
-	rsp.ContentLength = int64(newMets.Len())
+	streamResponse(rsp, sr)
 	return nil
 }
 
-func decodeMetric(input io.Reader, format expfmt.Format) (ret []*clientmodel.MetricFamily, err error) {
-	dec := expfmt.NewDecoder(input, format)
-
-	for {
-		var met clientmodel.MetricFamily
-		if err = dec.Decode(&met); err == nil {
-			ret = append(ret, &met)
-		} else if err == io.EOF {
-			return ret, nil
-		} else {
-			return nil, err
-		}
+// responseFormat returns the exposition format of a scrape response by its Content-Type. Responses without
+// a known Content-Type are taken as text, as Prometheus does, protobuf in other than the delimited encoding is unknown.
+func responseFormat(h http.Header) expfmt.Format {
+	mediatype, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return expfmt.FmtText
+	}
+	switch mediatype {
+	case expfmt.OpenMetricsType:
+		return expfmt.FmtOpenMetrics
+	case expfmt.ProtoType:
+		return expfmt.ResponseFormat(h)
+	default:
+		return expfmt.FmtText
 	}
 }
 
@@ -106,3 +155,472 @@ func appendLabelPairIfAbsent(mfs []*clientmodel.MetricFamily, pairs map[string]s
 		}
 	}
 }
+
+// relabelFamily relabels the metrics of mf, its name is their __name__ label. Metrics renamed are moved to
+// families of their new name, of the same type and help.
+//
+// Histograms and summaries are relabeled by their series, as Prometheus does: the _bucket series with le,
+// the quantiles with quantile, _sum and _count. A metric of which all series are kept and end up with the same
+// labels and with their suffixes on a common name stays a histogram or summary of that name. Otherwise each
+// series kept is written as an untyped metric of its own name, and native buckets are lost. Native histograms
+// without classic buckets are a single series of the family name.
+func relabelFamily(mf *clientmodel.MetricFamily, r *relabeler) []*clientmodel.MetricFamily {
+	var families []*clientmodel.MetricFamily
+	add := func(name string, typ clientmodel.MetricType, m *clientmodel.Metric) {
+		for _, f := range families {
+			if f.GetName() == name && f.GetType() == typ {
+				f.Metric = append(f.Metric, m)
+				return
+			}
+		}
+		families = append(families, &clientmodel.MetricFamily{Name: proto.String(name), Help: mf.Help, Type: typ.Enum(), Metric: []*clientmodel.Metric{m}})
+	}
+
+	var ls labelSet
+	for _, m := range mf.Metric {
+		series := classicSeries(mf.GetType(), m)
+		if series == nil {
+			relabeled, keep := r.relabel(seriesLabels(ls, mf.GetName(), m, nil))
+			ls = relabeled
+			if name := relabeled.get(model.MetricNameLabel); keep && name != "" {
+				m.Label = metricLabels(m.Label[:0], relabeled)
+				add(name, mf.GetType(), m)
+			}
+			continue
+		}
+
+		name, labels, whole := relabelSeries(r, mf.GetName(), m, series)
+		if whole {
+			m.Label = labels
+			add(name, mf.GetType(), m)
+			continue
+		}
+		for _, s := range series {
+			relabeled, keep := r.relabel(seriesLabels(ls, mf.GetName()+s.suffix, m, s.label))
+			ls = relabeled
+			name := relabeled.get(model.MetricNameLabel)
+			if !keep || name == "" {
+				continue
+			}
+			add(name, clientmodel.MetricType_UNTYPED, &clientmodel.Metric{
+				Label:       metricLabels(nil, relabeled),
+				Untyped:     &clientmodel.Untyped{Value: proto.Float64(s.value)},
+				TimestampMs: m.TimestampMs,
+			})
+		}
+	}
+	return families
+}
+
+// series is a series of a histogram or summary metric.
+type series struct {
+	suffix string
+	label  *labelPair // le or quantile
+	value  float64
+}
+
+// classicSeries returns the series of a histogram or summary m, or nil if m is of another type or
+// a native histogram without classic buckets.
+func classicSeries(typ clientmodel.MetricType, m *clientmodel.Metric) []series {
+	var ss []series
+	switch typ {
+	case clientmodel.MetricType_SUMMARY:
+		s := m.GetSummary()
+		for _, q := range s.GetQuantile() {
+			ss = append(ss, series{label: &labelPair{name: model.QuantileLabel, value: formatFloat(q.GetQuantile())}, value: q.GetValue()})
+		}
+		return append(ss, series{suffix: "_sum", value: s.GetSampleSum()}, series{suffix: "_count", value: float64(s.GetSampleCount())})
+	case clientmodel.MetricType_HISTOGRAM, clientmodel.MetricType_GAUGE_HISTOGRAM:
+		h := m.GetHistogram()
+		if len(h.GetBucket()) == 0 && (h.GetSchema() != 0 || h.GetZeroThreshold() != 0 || len(h.GetPositiveSpan()) > 0 || len(h.GetNegativeSpan()) > 0) {
+			return nil
+		}
+		count := float64(h.GetSampleCount())
+		if h.GetSampleCountFloat() > 0 {
+			count = h.GetSampleCountFloat()
+		}
+		inf := false
+		for _, b := range h.GetBucket() {
+			value := float64(b.GetCumulativeCount())
+			if b.GetCumulativeCountFloat() > 0 {
+				value = b.GetCumulativeCountFloat()
+			}
+			inf = math.IsInf(b.GetUpperBound(), +1)
+			ss = append(ss, series{suffix: "_bucket", label: &labelPair{name: model.BucketLabel, value: formatFloat(b.GetUpperBound())}, value: value})
+		}
+		if !inf {
+			ss = append(ss, series{suffix: "_bucket", label: &labelPair{name: model.BucketLabel, value: "+Inf"}, value: count})
+		}
+		return append(ss, series{suffix: "_sum", value: h.GetSampleSum()}, series{suffix: "_count", value: count})
+	default:
+		return nil
+	}
+}
+
+// relabelSeries relabels the series of m, a metric of the family name. It returns the new family name and
+// labels of m if all its series are kept with the same labels besides theirs and with their suffixes on the
+// same name, whole is false otherwise.
+func relabelSeries(r *relabeler, name string, m *clientmodel.Metric, ss []series) (newName string, labels []*clientmodel.LabelPair, whole bool) {
+	var ls, first labelSet
+	for i, s := range ss {
+		relabeled, keep := r.relabel(seriesLabels(ls, name+s.suffix, m, s.label))
+		ls = relabeled
+		seriesName := relabeled.get(model.MetricNameLabel)
+		if !keep || !strings.HasSuffix(seriesName, s.suffix) || len(seriesName) == len(s.suffix) {
+			return "", nil, false
+		}
+		if s.label != nil {
+			if relabeled.get(s.label.name) != s.label.value {
+				return "", nil, false
+			}
+			relabeled = relabeled.set(s.label.name, "")
+		}
+		relabeled = relabeled.set(model.MetricNameLabel, "")
+		if i == 0 {
+			newName, first = strings.TrimSuffix(seriesName, s.suffix), append(labelSet(nil), relabeled...)
+			continue
+		}
+		if strings.TrimSuffix(seriesName, s.suffix) != newName || !sameLabels(first, relabeled) {
+			return "", nil, false
+		}
+	}
+	return newName, metricLabels(m.Label[:0], first), true
+}
+
+// seriesLabels returns ls reset to the labels of a series of m named name, with label if any.
+func seriesLabels(ls labelSet, name string, m *clientmodel.Metric, label *labelPair) labelSet {
+	ls = append(ls[:0], labelPair{name: model.MetricNameLabel, value: name})
+	for _, l := range m.Label {
+		ls = append(ls, labelPair{name: l.GetName(), value: l.GetValue()})
+	}
+	if label != nil {
+		ls = append(ls, *label)
+	}
+	return ls
+}
+
+// metricLabels appends the labels of ls but __name__ to labels.
+func metricLabels(labels []*clientmodel.LabelPair, ls labelSet) []*clientmodel.LabelPair {
+	for _, l := range ls {
+		if l.name != model.MetricNameLabel {
+			labels = append(labels, &clientmodel.LabelPair{Name: proto.String(l.name), Value: proto.String(l.value)})
+		}
+	}
+	return labels
+}
+
+func sameLabels(a, b labelSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, l := range a {
+		if b.get(l.name) != l.value {
+			return false
+		}
+	}
+	return true
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// textInjector adds labels to the samples of a text or OpenMetrics exposition line by line. Comments and
+// everything after the label set, like the value, timestamp and exemplar, are copied unchanged.
+// Its buffers are reused from line to line, so it doesn't allocate once they've grown to the longest line.
+type textInjector struct {
+	br        *bufio.Reader
+	labels    []renderedLabel
+	relabeler *relabeler // nil without relabel rules
+	long      []byte     // a line longer than the buffer of br
+	out       []byte
+	provided  [][]byte
+	values    [][]byte // the escaped values of provided
+	labelSet  labelSet
+	// meta holds the # HELP, # TYPE and # UNIT lines of family while relabeling, until its first sample kept
+	meta   []byte
+	family []byte
+}
+
+// next copies the next line to w, adding the labels absent from a sample.
+func (t *textInjector) next(w io.Writer) error {
+	line, err := t.readLine()
+	if len(line) > 0 {
+		out, ierr := t.inject(line)
+		if ierr != nil {
+			return ierr
+		}
+		if _, werr := w.Write(out); werr != nil {
+			return werr
+		}
+	}
+	return err
+}
+
+func (t *textInjector) readLine() ([]byte, error) {
+	line, err := t.br.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+	t.long = append(t.long[:0], line...)
+	for err == bufio.ErrBufferFull {
+		line, err = t.br.ReadSlice('\n')
+		t.long = append(t.long, line...)
+	}
+	return t.long, err
+}
+
+// inject returns line with the labels it doesn't have, relabeled, or nil if the sample is dropped.
+// The returned slice is valid until the next call.
+func (t *textInjector) inject(line []byte) ([]byte, error) {
+	sample := bytes.TrimLeft(line, " \t")
+	if t.relabeler != nil && len(sample) > 0 && sample[0] == '#' {
+		if family, _ := metadataFamily(line); family != nil {
+			if !bytes.Equal(family, t.family) {
+				t.meta, t.family = t.meta[:0], append(t.family[:0], family...)
+			}
+			t.meta = append(t.meta, line...)
+			return nil, nil
+		}
+	}
+	if len(sample) == 0 || sample[0] == '#' || sample[0] == '\n' || sample[0] == '\r' {
+		return line, nil
+	}
+
+	start := len(line) - len(sample)
+	nameEnd := bytes.IndexAny(sample, "{ \t")
+	if nameEnd <= 0 {
+		return nil, fmt.Errorf("malformed sample %q", bytes.TrimSpace(line))
+	}
+	nameEnd += start
+
+	var err error
+	var labelsEnd int
+	t.provided, t.values = t.provided[:0], t.values[:0]
+	if line[nameEnd] == '{' {
+		if t.provided, t.values, labelsEnd, err = parseLabels(line, nameEnd+1, t.provided, t.values); err != nil {
+			return nil, err
+		}
+	}
+	if t.relabeler != nil {
+		return t.relabel(line, start, nameEnd, labelsEnd), nil
+	}
+
+	t.out = t.out[:0]
+	sep := ""
+	if labelsEnd > 0 {
+		t.out = append(t.out, line[:labelsEnd]...)
+		if last := bytes.TrimRight(line[nameEnd+1:labelsEnd], " \t"); len(last) > 0 && last[len(last)-1] != ',' {
+			sep = ","
+		}
+	} else {
+		t.out = append(t.out, line[:nameEnd]...)
+		t.out = append(t.out, '{')
+	}
+	injected := false
+labels:
+	for _, l := range t.labels {
+		for _, p := range t.provided {
+			if bytes.Equal(p, l.name) {
+				continue labels
+			}
+		}
+		t.out = append(t.out, sep...)
+		t.out = append(t.out, l.pair...)
+		sep, injected = ",", true
+	}
+	if !injected {
+		return line, nil
+	}
+	if labelsEnd > 0 {
+		t.out = append(t.out, line[labelsEnd:]...)
+	} else {
+		t.out = append(t.out, '}')
+		t.out = append(t.out, line[nameEnd:]...)
+	}
+	return t.out, nil
+}
+
+// relabel returns the sample of line, its name from start to nameEnd and its labels until labelsEnd if any,
+// with the labels it doesn't have and relabeled, or nil if it's dropped. The metadata lines of its family are
+// written before the first sample kept, renamed like it, or dropped if it's renamed apart from its suffix.
+func (t *textInjector) relabel(line []byte, start, nameEnd, labelsEnd int) []byte {
+	ls := append(t.labelSet[:0], labelPair{name: model.MetricNameLabel, value: string(line[start:nameEnd])})
+	for i, name := range t.provided {
+		ls = append(ls, labelPair{name: string(name), value: unescapeLabelValue(t.values[i])})
+	}
+labels:
+	for _, l := range t.labels {
+		for _, p := range t.provided {
+			if bytes.Equal(p, l.name) {
+				continue labels
+			}
+		}
+		ls = append(ls, labelPair{name: string(l.name), value: l.value})
+	}
+	t.labelSet = ls
+
+	ls, keep := t.relabeler.relabel(ls)
+	name := ls.get(model.MetricNameLabel)
+	t.out = t.out[:0]
+	if len(t.meta) > 0 {
+		suffix, ok := familySuffix(line[start:nameEnd], t.family)
+		if !ok {
+			// the family had no samples kept
+			t.meta, t.family = t.meta[:0], t.family[:0]
+		} else if keep && name != "" {
+			if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+				t.out = appendMetadata(t.out, t.meta, name[:len(name)-len(suffix)])
+			}
+			t.meta, t.family = t.meta[:0], t.family[:0]
+		}
+	}
+	if !keep || name == "" {
+		return t.out
+	}
+	t.out = append(t.out, line[:start]...)
+	t.out = append(t.out, name...)
+	sep := byte('{')
+	for _, l := range ls {
+		if l.name == model.MetricNameLabel {
+			continue
+		}
+		t.out = append(t.out, sep)
+		t.out = append(t.out, l.name...)
+		t.out = append(t.out, '=', '"')
+		t.out = append(t.out, labelValueEscaper.Replace(l.value)...)
+		t.out = append(t.out, '"')
+		sep = ','
+	}
+	if sep == ',' {
+		t.out = append(t.out, '}')
+	}
+	if labelsEnd > 0 {
+		return append(t.out, line[labelsEnd+1:]...)
+	}
+	return append(t.out, line[nameEnd:]...)
+}
+
+// metadataSuffixes are the suffixes of the samples of a family in the text formats.
+var metadataSuffixes = []string{"_total", "_created", "_bucket", "_sum", "_count", "_gsum", "_gcount", "_info"}
+
+// familySuffix returns the suffix of the sample name to the family name, and whether the sample is of the family.
+func familySuffix(name, family []byte) (string, bool) {
+	if !bytes.HasPrefix(name, family) {
+		return "", false
+	}
+	suffix := name[len(family):]
+	if len(suffix) == 0 {
+		return "", true
+	}
+	for _, s := range metadataSuffixes {
+		if string(suffix) == s {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// metadataFamily returns the family name of a # HELP, # TYPE or # UNIT line and the index after it,
+// or nil for other lines.
+func metadataFamily(line []byte) ([]byte, int) {
+	i := 0
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	if i == len(line) || line[i] != '#' {
+		return nil, 0
+	}
+	for i++; i < len(line) && (line[i] == ' ' || line[i] == '\t'); i++ {
+	}
+	rest := line[i:]
+	if !bytes.HasPrefix(rest, []byte("HELP ")) && !bytes.HasPrefix(rest, []byte("TYPE ")) && !bytes.HasPrefix(rest, []byte("UNIT ")) {
+		return nil, 0
+	}
+	for i += 5; i < len(line) && (line[i] == ' ' || line[i] == '\t'); i++ {
+	}
+	nameStart := i
+	for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\n' && line[i] != '\r' {
+		i++
+	}
+	if i == nameStart {
+		return nil, 0
+	}
+	return line[nameStart:i], i
+}
+
+// appendMetadata appends the metadata lines of meta to out, renamed to family.
+func appendMetadata(out, meta []byte, family string) []byte {
+	for len(meta) > 0 {
+		end := bytes.IndexByte(meta, '\n') + 1
+		if end == 0 {
+			end = len(meta)
+		}
+		line := meta[:end]
+		name, nameEnd := metadataFamily(line)
+		out = append(out, line[:nameEnd-len(name)]...)
+		out = append(out, family...)
+		out = append(out, line[nameEnd:]...)
+		meta = meta[end:]
+	}
+	return out
+}
+
+// unescapeLabelValue returns the value of an escaped label value of the text formats.
+func unescapeLabelValue(escaped []byte) string {
+	if bytes.IndexByte(escaped, '\\') < 0 {
+		return string(escaped)
+	}
+	value := make([]byte, 0, len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == '\\' && i+1 < len(escaped) {
+			i++
+			if escaped[i] == 'n' {
+				value = append(value, '\n')
+				continue
+			}
+		}
+		value = append(value, escaped[i])
+	}
+	return string(value)
+}
+
+// parseLabels appends the names and escaped values of the label set of line starting at i, after its
+// opening brace, to names and values. It returns the index of the closing brace.
+func parseLabels(line []byte, i int, names, values [][]byte) ([][]byte, [][]byte, int, error) {
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t' || line[i] == ',') {
+			i++
+		}
+		if i < len(line) && line[i] == '}' {
+			return names, values, i, nil
+		}
+		nameStart := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		name := line[nameStart:i]
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if len(name) == 0 || i+1 >= len(line) || line[i] != '=' {
+			return nil, nil, 0, fmt.Errorf("malformed label set in %q", bytes.TrimSpace(line))
+		}
+		for i++; i < len(line) && (line[i] == ' ' || line[i] == '\t'); i++ {
+		}
+		if i >= len(line) || line[i] != '"' {
+			return nil, nil, 0, fmt.Errorf("malformed label value in %q", bytes.TrimSpace(line))
+		}
+		valueStart := i + 1
+		for i++; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' {
+				i++
+			}
+		}
+		if i >= len(line) {
+			return nil, nil, 0, fmt.Errorf("unterminated label value in %q", bytes.TrimSpace(line))
+		}
+		names, values = append(names, name), append(values, line[valueStart:i])
+		i++
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+var testLabelPairs = map[string]string{"cluster": "a\"b", "instance": "host"}
+
+func modify(t testing.TB, contentType, encoding string, body io.Reader) *http.Response {
+	rsp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       ioutil.NopCloser(body),
+	}
+	if encoding != "" {
+		rsp.Header.Set("Content-Encoding", encoding)
+	}
+	if err := newMetricModifier(testLabelPairs, nil).injectLabelParis(rsp, nil); err != nil {
+		t.Fatal(err)
+	}
+	return rsp
+}
+
+func encode(t testing.TB, encoding string, body []byte) []byte {
+	var buf bytes.Buffer
+	w, release, err := encodeBody(&buf, encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w == nil {
+		return body
+	}
+	defer release()
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+func decode(t testing.TB, encoding string, r io.Reader) string {
+	dr, release, err := decodeBody(r, encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	out, err := ioutil.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestInjectLabelsText(t *testing.T) {
+	in := `# HELP up Up.
+# TYPE up gauge
+up 1
+up{instance="exporter"} 1 1600000000000
+http_requests_total{code="200",} 3
+
+  foo{ path="a\"}" , code = "2"} 1
+`
+	want := `# HELP up Up.
+# TYPE up gauge
+up{cluster="a\"b",instance="host"} 1
+up{instance="exporter",cluster="a\"b"} 1 1600000000000
+http_requests_total{code="200",cluster="a\"b",instance="host"} 3
+
+  foo{ path="a\"}" , code = "2",cluster="a\"b",instance="host"} 1
+`
+	for _, contentType := range []string{string(expfmt.FmtText), ""} {
+		rsp := modify(t, contentType, "", strings.NewReader(in))
+		out, _ := ioutil.ReadAll(rsp.Body)
+		assert.Equal(t, want, string(out))
+		assert.Equal(t, int64(-1), rsp.ContentLength)
+		assert.Equal(t, []string{"chunked"}, rsp.TransferEncoding)
+		assert.NoError(t, rsp.Body.Close())
+	}
+
+	for _, encoding := range []string{"gzip", "deflate", "zstd"} {
+		rsp := modify(t, string(expfmt.FmtText), encoding, bytes.NewReader(encode(t, encoding, []byte(in))))
+		assert.Equal(t, want, decode(t, encoding, rsp.Body), encoding)
+		assert.Equal(t, encoding, rsp.Header.Get("Content-Encoding"))
+		rsp.Body.Close()
+	}
+
+	// a line longer than the read buffer
+	long := "long{value=\"" + strings.Repeat("x", 2*bufReaderSize) + "\"} 1\n"
+	rsp := modify(t, string(expfmt.FmtText), "", strings.NewReader(long+"up 1"))
+	out, _ := ioutil.ReadAll(rsp.Body)
+	assert.Equal(t, long[:len(long)-4]+`,cluster="a\"b",instance="host"} 1`+"\n"+`up{cluster="a\"b",instance="host"} 1`, string(out))
+
+	// a body malformed early fails before the response is sent, later on reading it
+	err := newMetricModifier(testLabelPairs, nil).injectLabelParis(&http.Response{
+		Header: http.Header{"Content-Type": {string(expfmt.FmtText)}},
+		Body:   ioutil.NopCloser(strings.NewReader("up 1\nup{instance=\"x} 1\n")),
+	}, nil)
+	assert.EqualError(t, err, `unterminated label value in "up{instance=\"x} 1"`)
+	rsp = modify(t, string(expfmt.FmtText), "", strings.NewReader(long+long+"up{instance=\"x} 1\n"))
+	_, err = ioutil.ReadAll(rsp.Body)
+	assert.IsType(t, &streamError{}, err)
+
+	err = newMetricModifier(testLabelPairs, nil).injectLabelParis(&http.Response{
+		Header: http.Header{"Content-Type": {string(expfmt.FmtText)}, "Content-Encoding": {"br"}},
+		Body:   ioutil.NopCloser(strings.NewReader("")),
+	}, nil)
+	assert.EqualError(t, err, `unsupported content encoding "br"`)
+}
+
+func TestInjectLabelsOpenMetrics(t *testing.T) {
+	in := `# TYPE requests counter
+# HELP requests Requests.
+requests_total{code="200"} 3 # {trace_id="KOO5S4vxi0o"} 0.67 1600000000.000
+requests_created{code="200"} 1600000000.000
+# EOF
+`
+	want := `# TYPE requests counter
+# HELP requests Requests.
+requests_total{code="200",cluster="a\"b",instance="host"} 3 # {trace_id="KOO5S4vxi0o"} 0.67 1600000000.000
+requests_created{code="200",cluster="a\"b",instance="host"} 1600000000.000
+# EOF
+`
+	rsp := modify(t, string(expfmt.FmtOpenMetrics), "", strings.NewReader(in))
+	out, _ := ioutil.ReadAll(rsp.Body)
+	assert.Equal(t, want, string(out))
+}
+
+func TestInjectLabelsProtobuf(t *testing.T) {
+	mf := &clientmodel.MetricFamily{
+		Name: proto.String("latency_seconds"),
+		Type: clientmodel.MetricType_HISTOGRAM.Enum(),
+		Metric: []*clientmodel.Metric{{
+			Label: []*clientmodel.LabelPair{{Name: proto.String("instance"), Value: proto.String("exporter")}},
+			Histogram: &clientmodel.Histogram{
+				SampleCount:   proto.Uint64(3),
+				SampleSum:     proto.Float64(1.5),
+				Schema:        proto.Int32(3),
+				ZeroThreshold: proto.Float64(1e-128),
+				ZeroCount:     proto.Uint64(1),
+				PositiveSpan:  []*clientmodel.BucketSpan{{Offset: proto.Int32(-2), Length: proto.Uint32(2)}},
+				PositiveDelta: []int64{1, 0},
+			},
+		}},
+	}
+	var in bytes.Buffer
+	assert.NoError(t, expfmt.NewEncoder(&in, expfmt.FmtProtoDelim).Encode(mf))
+
+	rsp := modify(t, string(expfmt.FmtProtoDelim), "gzip", bytes.NewReader(encode(t, "gzip", in.Bytes())))
+	dec := expfmt.NewDecoder(strings.NewReader(decode(t, "gzip", rsp.Body)), expfmt.FmtProtoDelim)
+	var got clientmodel.MetricFamily
+	if !assert.NoError(t, dec.Decode(&got)) {
+		return
+	}
+	assert.Equal(t, io.EOF, dec.Decode(&clientmodel.MetricFamily{}))
+	m := got.Metric[0]
+	labels := map[string]string{}
+	for _, l := range m.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, map[string]string{"instance": "exporter", "cluster": "a\"b"}, labels)
+	assert.True(t, proto.Equal(mf.Metric[0].Histogram, m.Histogram), "native histogram changed: %v", m.Histogram)
+
+	err := newMetricModifier(testLabelPairs, nil).injectLabelParis(&http.Response{
+		Header: http.Header{"Content-Type": {string(expfmt.FmtProtoText)}},
+		Body:   ioutil.NopCloser(strings.NewReader("")),
+	}, nil)
+	assert.Error(t, err)
+}
+
+// exposition returns a text exposition of n series like kube-state-metrics.
+func exposition(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# HELP kube_pod_status_phase The pods current phase.\n# TYPE kube_pod_status_phase gauge\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "kube_pod_status_phase{namespace=\"namespace-%d\",pod=\"pod-%d\",uid=\"%08x-7b0c-4a4e-9d6a-0242ac120002\",phase=\"Running\"} 1\n", i%100, i, i)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkInjectLabels(b *testing.B) {
+	in := exposition(500000) // about 70MB
+	for _, encoding := range []string{"identity", "gzip", "deflate", "zstd"} {
+		body := encode(b, encoding, in)
+		b.Run(encoding, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rsp := modify(b, string(expfmt.FmtText), encoding, bytes.NewReader(body))
+				if _, err := io.Copy(ioutil.Discard, rsp.Body); err != nil {
+					b.Fatal(err)
+				}
+				rsp.Body.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Naming strategies of endpoints without an explicit name.
+const (
+	// NamingBase64 names an endpoint base64(host+path), the names aren't valid DNS labels
+	NamingBase64 = "base64"
+	// NamingTemplate names an endpoint after Naming.Template
+	NamingTemplate = "template"
+	// NamingHash names an endpoint by a short hash of its URL
+	NamingHash = "hash"
+
+	// reservedName is scraped by the proxy as all processes of the client at once
+	reservedName = "all"
+
+	defaultNamingTemplate = "{{port}}-{{path}}"
+	maxDNSLabelLength     = 63
+)
+
+var (
+	dnsLabel            = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	namingPlaceholder   = regexp.MustCompile(`{{\s*(\w*)\s*}}`)
+	invalidDNSLabelChar = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// Naming configures how endpoints without an explicit name are named.
+type Naming struct {
+	// Strategy is one of base64 (default), template and hash
+	Strategy string `yaml:"strategy,omitempty"`
+	// Template names endpoints for the template strategy, placeholders are
+	// {{scheme}}, {{host}}, {{hostname}}, {{port}} and {{path}}, i.e {{port}}-{{path}}
+	Template string `yaml:"template,omitempty"`
+}
+
+// name returns the name of the endpoint at u.
+func (n *Naming) name(u *url.URL) (string, error) {
+	switch n.Strategy {
+	case "", NamingBase64:
+		return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s%s", u.Host, u.Path))), nil
+	case NamingHash:
+		sum := sha256.Sum256([]byte(u.Host + u.Path))
+		return hex.EncodeToString(sum[:4]), nil
+	case NamingTemplate:
+		tmpl := n.Template
+		if tmpl == "" {
+			tmpl = defaultNamingTemplate
+		}
+		var err error
+		name := namingPlaceholder.ReplaceAllStringFunc(tmpl, func(p string) string {
+			v, ok := urlPart(u, namingPlaceholder.FindStringSubmatch(p)[1])
+			if !ok && err == nil {
+				err = fmt.Errorf("unknown placeholder %s in naming template %q", p, tmpl)
+			}
+			return v
+		})
+		return sanitizeDNSLabel(name), err
+	default:
+		return "", fmt.Errorf("unknown naming strategy %q", n.Strategy)
+	}
+}
+
+func urlPart(u *url.URL, part string) (string, bool) {
+	switch part {
+	case "scheme":
+		return u.Scheme, true
+	case "host":
+		return u.Host, true
+	case "hostname":
+		return u.Hostname(), true
+	case "port":
+		if port := u.Port(); port != "" {
+			return port, true
+		}
+		if u.Scheme == "https" {
+			return "443", true
+		}
+		return "80", true
+	case "path":
+		return u.Path, true
+	}
+	return "", false
+}
+
+// sanitizeDNSLabel lower cases s and replaces runs of characters not valid in DNS labels with a dash.
+func sanitizeDNSLabel(s string) string {
+	s = invalidDNSLabelChar.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > maxDNSLabelLength {
+		s = s[:maxDNSLabelLength]
+	}
+	return strings.Trim(s, "-")
+}
+
+// isDNSLabel reports whether name is a valid DNS label.
+func isDNSLabel(name string) bool {
+	return len(name) <= maxDNSLabelLength && dnsLabel.MatchString(name)
+}
+
+// nameEndpoints names the endpoints without an explicit name and validates the generated names
+// as DNS labels, except the legacy base64 ones. Explicit names are kept as they are, they have
+// always been accepted. Endpoints sharing a name are reported.
+func nameEndpoints(eps []Endpoint, naming *Naming) error {
+	byName := map[string]*Endpoint{}
+	for i := range eps {
+		ep := &eps[i]
+		if ep.URL == nil {
+			return fmt.Errorf("endpoint %q lacks an url", ep.Name)
+		}
+		if ep.Name == "" {
+			name, err := naming.name(ep.URL)
+			if err != nil {
+				return err
+			}
+			if naming.Strategy != "" && naming.Strategy != NamingBase64 && !isDNSLabel(name) {
+				return fmt.Errorf("name %q of endpoint %s is not a valid DNS label", name, ep.URL)
+			}
+			ep.Name = name
+		}
+		if ep.Name == reservedName {
+			return fmt.Errorf("name %q of endpoint %s is reserved", ep.Name, ep.URL)
+		}
+		if other, ok := byName[ep.Name]; ok {
+			return fmt.Errorf("endpoints %s and %s are both named %q", other.URL, ep.URL, ep.Name)
+		}
+		byName[ep.Name] = ep
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameEndpoints(t *testing.T) {
+	endpoints := func(urls ...string) []Endpoint {
+		var eps []Endpoint
+		for _, u := range urls {
+			URL, err := url.Parse(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			eps = append(eps, Endpoint{URL: URL})
+		}
+		return eps
+	}
+	names := func(eps []Endpoint) []string {
+		var names []string
+		for _, ep := range eps {
+			names = append(names, ep.Name)
+		}
+		return names
+	}
+
+	eps := endpoints("http://127.0.0.1:9100/metrics")
+	assert.NoError(t, nameEndpoints(eps, &Naming{}))
+	assert.Equal(t, []string{"MTI3LjAuMC4xOjkxMDAvbWV0cmljcw=="}, names(eps))
+
+	eps = endpoints("http://127.0.0.1:9100/metrics", "https://localhost/Stats/JVM", "http://10.0.0.1:8080/")
+	assert.NoError(t, nameEndpoints(eps, &Naming{Strategy: NamingTemplate, Template: defaultNamingTemplate}))
+	assert.Equal(t, []string{"9100-metrics", "443-stats-jvm", "8080"}, names(eps))
+
+	eps = endpoints("http://127.0.0.1:9100/metrics")
+	assert.NoError(t, nameEndpoints(eps, &Naming{Strategy: NamingTemplate, Template: "{{hostname}}-{{ port }}"}))
+	assert.Equal(t, []string{"127-0-0-1-9100"}, names(eps))
+
+	eps = endpoints("http://127.0.0.1:9100/metrics", "http://127.0.0.1:9200/metrics")
+	assert.NoError(t, nameEndpoints(eps, &Naming{Strategy: NamingHash}))
+	assert.Len(t, eps[0].Name, 8)
+	assert.NotEqual(t, eps[0].Name, eps[1].Name)
+
+	// explicit names are kept, even if they aren't DNS labels
+	eps = endpoints("http://127.0.0.1:9100/metrics")
+	eps[0].Name = "node_exporter"
+	assert.NoError(t, nameEndpoints(eps, &Naming{Strategy: NamingTemplate, Template: defaultNamingTemplate}))
+	assert.Equal(t, []string{"node_exporter"}, names(eps))
+	assert.False(t, isDNSLabel(eps[0].Name))
+	eps[0].Name = "node-exporter"
+	assert.NoError(t, nameEndpoints(eps, &Naming{}))
+	assert.True(t, isDNSLabel(eps[0].Name))
+	eps[0].Name = reservedName
+	assert.Error(t, nameEndpoints(eps, &Naming{}))
+
+	// collisions are reported
+	eps = endpoints("http://127.0.0.1:9100/metrics", "http://localhost:9100/metrics")
+	err := nameEndpoints(eps, &Naming{Strategy: NamingTemplate, Template: "{{port}}"})
+	assert.EqualError(t, err, `endpoints http://127.0.0.1:9100/metrics and http://localhost:9100/metrics are both named "9100"`)
+
+	eps = endpoints("http://127.0.0.1:9100/metrics")
+	assert.Error(t, nameEndpoints(eps, &Naming{Strategy: NamingTemplate, Template: "{{bogus}}"}))
+	assert.Error(t, nameEndpoints(eps, &Naming{Strategy: "bogus"}))
+	eps = endpoints("http://127.0.0.1:9100/metrics")
+	assert.Error(t, nameEndpoints(eps, &Naming{Strategy: NamingTemplate, Template: "---"}))
+}
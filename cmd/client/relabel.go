@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+// Relabel actions, as of Prometheus.
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelHashMod   = "hashmod"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+var relabelTarget = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+
+// RelabelConfig is a rule of metric_relabel_configs, it behaves like the one of Prometheus.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        Regexp   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, it applies the defaults of Prometheus and validates the rule.
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelabelConfig
+	*c = RelabelConfig{Separator: ";", Regex: MustNewRegexp("(.*)"), Replacement: "$1", Action: RelabelReplace}
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+func (c *RelabelConfig) validate() error {
+	switch c.Action {
+	case RelabelReplace, RelabelHashMod:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires target_label", c.Action)
+		}
+		if c.Action == RelabelReplace && !relabelTarget.MatchString(c.TargetLabel) {
+			return fmt.Errorf("%q is invalid target_label for action %s", c.TargetLabel, c.Action)
+		}
+		if c.Action == RelabelHashMod && !model.LabelName(c.TargetLabel).IsValid() {
+			return fmt.Errorf("%q is invalid target_label for action %s", c.TargetLabel, c.Action)
+		}
+		if c.Action == RelabelHashMod && c.Modulus == 0 {
+			return fmt.Errorf("relabel action %s requires a non-zero modulus", c.Action)
+		}
+	case RelabelKeep, RelabelDrop:
+	case RelabelLabelDrop, RelabelLabelKeep:
+		if c.SourceLabels != nil || c.TargetLabel != "" || c.Modulus != 0 || c.Separator != ";" || c.Replacement != "$1" {
+			return fmt.Errorf("relabel action %s requires only regex, and no other fields", c.Action)
+		}
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+	for _, l := range c.SourceLabels {
+		if !model.LabelName(l).IsValid() {
+			return fmt.Errorf("%q is invalid source label", l)
+		}
+	}
+	return nil
+}
+
+// Regexp is a regular expression anchored at both ends, as in relabel rules of Prometheus.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp returns the Regexp of s.
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	return Regexp{Regexp: re, original: s}, err
+}
+
+// MustNewRegexp is like NewRegexp but panics if s doesn't compile.
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	r, err := NewRegexp(s)
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", s, err)
+	}
+	*re = r
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (re Regexp) MarshalYAML() (interface{}, error) {
+	return re.original, nil
+}
+
+// labelPair is a label of a sample while it's relabeled, the metric name is the __name__ label.
+type labelPair struct {
+	name, value string
+}
+
+type labelSet []labelPair
+
+func (ls labelSet) get(name string) string {
+	for _, l := range ls {
+		if l.name == name {
+			return l.value
+		}
+	}
+	return ""
+}
+
+// set sets the value of a label in place, or appends it, an empty value deletes it.
+func (ls labelSet) set(name, value string) labelSet {
+	for i, l := range ls {
+		if l.name == name {
+			if value == "" {
+				return append(ls[:i], ls[i+1:]...)
+			}
+			ls[i].value = value
+			return ls
+		}
+	}
+	if value == "" {
+		return ls
+	}
+	return append(ls, labelPair{name: name, value: value})
+}
+
+// relabeler applies relabel rules to samples, it reuses its buffer of the values of the source labels
+// from rule to rule and sample to sample, so keep, drop and hashmod rules don't allocate.
+type relabeler struct {
+	cfgs   []*RelabelConfig
+	values []byte
+}
+
+// relabel applies the rules to ls in order, it returns false if the sample is dropped.
+// ls is modified in place.
+func (r *relabeler) relabel(ls labelSet) (labelSet, bool) {
+	for _, cfg := range r.cfgs {
+		r.values = r.values[:0]
+		for i, name := range cfg.SourceLabels {
+			if i > 0 {
+				r.values = append(r.values, cfg.Separator...)
+			}
+			r.values = append(r.values, ls.get(name)...)
+		}
+
+		switch cfg.Action {
+		case RelabelDrop:
+			if cfg.Regex.Match(r.values) {
+				return nil, false
+			}
+		case RelabelKeep:
+			if !cfg.Regex.Match(r.values) {
+				return nil, false
+			}
+		case RelabelReplace:
+			val := string(r.values)
+			indexes := cfg.Regex.FindStringSubmatchIndex(val)
+			// if there is no match no replacement must take place
+			if indexes == nil {
+				break
+			}
+			target := model.LabelName(cfg.Regex.ExpandString(nil, cfg.TargetLabel, val, indexes))
+			if !target.IsValid() {
+				break
+			}
+			res := cfg.Regex.ExpandString(nil, cfg.Replacement, val, indexes)
+			ls = ls.set(string(target), string(res))
+		case RelabelHashMod:
+			sum := md5.Sum(r.values)
+			mod := binary.BigEndian.Uint64(sum[8:]) % cfg.Modulus
+			ls = ls.set(cfg.TargetLabel, strconv.FormatUint(mod, 10))
+		case RelabelLabelDrop, RelabelLabelKeep:
+			kept := ls[:0]
+			for _, l := range ls {
+				if cfg.Regex.MatchString(l.name) == (cfg.Action == RelabelLabelKeep) {
+					kept = append(kept, l)
+				}
+			}
+			ls = kept
+		}
+	}
+	return ls, true
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func mustRelabelConfigs(t *testing.T, s string) []*RelabelConfig {
+	var cfgs []*RelabelConfig
+	if err := yaml.UnmarshalStrict([]byte(s), &cfgs); err != nil {
+		t.Fatal(err)
+	}
+	return cfgs
+}
+
+func TestRelabel(t *testing.T) {
+	for _, tc := range []struct {
+		name, rules string
+		in          labelSet
+		want        labelSet
+		drop        bool
+	}{
+		{
+			name:  "drop by name",
+			rules: `[{source_labels: [__name__], regex: "go_.*", action: drop}]`,
+			in:    labelSet{{"__name__", "go_goroutines"}},
+			drop:  true,
+		},
+		{
+			name:  "keep by label",
+			rules: `[{source_labels: [__name__, code], separator: "@", regex: "http_.*@5..", action: keep}]`,
+			in:    labelSet{{"__name__", "http_requests_total"}, {"code", "200"}},
+			drop:  true,
+		},
+		{
+			name:  "keep match",
+			rules: `[{source_labels: [code], regex: "2..", action: keep}]`,
+			in:    labelSet{{"__name__", "http_requests_total"}, {"code", "200"}},
+			want:  labelSet{{"__name__", "http_requests_total"}, {"code", "200"}},
+		},
+		{
+			name:  "replace",
+			rules: `[{source_labels: [path], regex: "/api/([^/]+)/.*", target_label: "${1}_api", replacement: "$1"}]`,
+			in:    labelSet{{"__name__", "requests"}, {"path", "/api/v1/query"}},
+			want:  labelSet{{"__name__", "requests"}, {"path", "/api/v1/query"}, {"v1_api", "v1"}},
+		},
+		{
+			name:  "replace without match",
+			rules: `[{source_labels: [path], regex: "/api/.*", target_label: api, replacement: x}]`,
+			in:    labelSet{{"__name__", "requests"}, {"path", "/"}},
+			want:  labelSet{{"__name__", "requests"}, {"path", "/"}},
+		},
+		{
+			name:  "replace deletes with empty value",
+			rules: `[{target_label: path, replacement: ""}]`,
+			in:    labelSet{{"__name__", "requests"}, {"path", "/"}},
+			want:  labelSet{{"__name__", "requests"}},
+		},
+		{
+			name:  "hashmod",
+			rules: `[{source_labels: [pod], modulus: 8, target_label: shard, action: hashmod}]`,
+			in:    labelSet{{"__name__", "up"}, {"pod", "pod-1"}},
+			want:  labelSet{{"__name__", "up"}, {"pod", "pod-1"}, {"shard", "7"}},
+		},
+		{
+			name:  "labeldrop",
+			rules: `[{regex: "uid|pod_.*", action: labeldrop}]`,
+			in:    labelSet{{"__name__", "up"}, {"uid", "1"}, {"pod_ip", "10.0.0.1"}, {"pod", "a"}},
+			want:  labelSet{{"__name__", "up"}, {"pod", "a"}},
+		},
+		{
+			name:  "labelkeep",
+			rules: `[{regex: "__name__|pod", action: labelkeep}]`,
+			in:    labelSet{{"__name__", "up"}, {"uid", "1"}, {"pod", "a"}},
+			want:  labelSet{{"__name__", "up"}, {"pod", "a"}},
+		},
+	} {
+		got, keep := (&relabeler{cfgs: mustRelabelConfigs(t, tc.rules)}).relabel(tc.in)
+		assert.Equal(t, !tc.drop, keep, tc.name)
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+
+	// the values of the source labels are joined in the buffer of the relabeler
+	r := &relabeler{cfgs: mustRelabelConfigs(t, `
+- {source_labels: [__name__, code], regex: "go_.*;", action: drop}
+- {source_labels: [pod, code], modulus: 8, target_label: shard, action: hashmod}`)}
+	ls := labelSet{{"__name__", "up"}, {"pod", "pod-1"}, {"code", "200"}, {"shard", "7"}}
+	assert.Zero(t, testing.AllocsPerRun(100, func() { r.relabel(ls) }))
+}
+
+func TestRelabelConfigValidation(t *testing.T) {
+	for _, tc := range []struct {
+		rules, err string
+	}{
+		{`[{action: lowercase}]`, `unknown relabel action "lowercase"`},
+		{`[{action: hashmod, target_label: shard}]`, "relabel action hashmod requires a non-zero modulus"},
+		{`[{action: replace, target_label: "1x"}]`, `"1x" is invalid target_label for action replace`},
+		{`[{action: labeldrop, regex: uid, target_label: x}]`, "relabel action labeldrop requires only regex, and no other fields"},
+		{`[{action: drop, regex: "("}]`, "invalid regex \"(\": error parsing regexp: missing closing ): `^(?:()$`"},
+	} {
+		var cfgs []*RelabelConfig
+		assert.EqualError(t, yaml.UnmarshalStrict([]byte(tc.rules), &cfgs), tc.err)
+	}
+
+	var conf Config
+	assert.NoError(t, yaml.UnmarshalStrict([]byte(`
+metrics:
+  - url: http://127.0.0.1:9100/metrics
+    metric_relabel_configs:
+      - {source_labels: [__name__], regex: "node_scrape_.*", action: drop}
+metric_relabel_configs:
+  - {regex: "uid", action: labeldrop}
+`), &conf))
+	assert.Len(t, conf.MetricRelabelConfigs, 1)
+	assert.Len(t, conf.Eps[0].MetricRelabelConfigs, 1)
+}
+
+func TestRelabelText(t *testing.T) {
+	relabelText := func(contentType, in string, mm *metricModifier, ep *Endpoint) string {
+		rsp := &http.Response{
+			Header: http.Header{"Content-Type": {contentType}},
+			Body:   ioutil.NopCloser(strings.NewReader(in)),
+		}
+		assert.NoError(t, mm.injectLabelParis(rsp, ep))
+		out, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		return string(out)
+	}
+
+	in := `# HELP kube_pod_info Information about pod.
+# TYPE kube_pod_info gauge
+kube_pod_info{namespace="kube-system",pod="dns",uid="1"} 1
+kube_pod_info{namespace="default",pod="web\\1\"",uid="2"} 1 1600000000000
+# HELP go_goroutines Number of goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 10
+`
+	mm := newMetricModifier(map[string]string{"cluster": "a"}, mustRelabelConfigs(t, `
+- {source_labels: [__name__], regex: "go_.*", action: drop}
+- {regex: uid, action: labeldrop}`))
+	ep := &Endpoint{MetricRelabelConfigs: mustRelabelConfigs(t, `
+- {source_labels: [namespace], regex: kube-system, action: drop}
+- {source_labels: [__name__], target_label: __name__, replacement: "ksm_$1"}`)}
+	assert.Equal(t, `# HELP ksm_kube_pod_info Information about pod.
+# TYPE ksm_kube_pod_info gauge
+ksm_kube_pod_info{namespace="default",pod="web\\1\"",cluster="a"} 1 1600000000000
+`, relabelText(string(expfmt.FmtText), in, mm, ep))
+
+	// the metadata of families is renamed along their suffixes, or dropped
+	in = `# TYPE latency histogram
+# UNIT latency seconds
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 1.5
+latency_count 2
+# TYPE up gauge
+up 1
+# EOF
+`
+	mm = newMetricModifier(nil, mustRelabelConfigs(t, `
+- {source_labels: [__name__], regex: "latency(_.*)", target_label: __name__, replacement: "http_latency$1"}
+- {source_labels: [__name__], regex: "up", target_label: __name__, replacement: "target_up_total"}`))
+	assert.Equal(t, `# TYPE http_latency histogram
+# UNIT http_latency seconds
+http_latency_bucket{le="1"} 1
+http_latency_bucket{le="+Inf"} 2
+http_latency_sum 1.5
+http_latency_count 2
+# TYPE target_up_total gauge
+target_up_total 1
+# EOF
+`, relabelText(string(expfmt.FmtOpenMetrics), in, mm, nil))
+
+	mm = newMetricModifier(nil, mustRelabelConfigs(t, `
+- {source_labels: [__name__], regex: "latency_bucket", target_label: __name__, replacement: "latency_buckets"}`))
+	assert.Equal(t, `latency_buckets{le="1"} 1
+latency_buckets{le="+Inf"} 2
+latency_sum 1.5
+latency_count 2
+# TYPE up gauge
+up 1
+# EOF
+`, relabelText(string(expfmt.FmtOpenMetrics), in, mm, nil))
+}
+
+func TestRelabelFamily(t *testing.T) {
+	mf := &clientmodel.MetricFamily{
+		Name: proto.String("requests_total"),
+		Help: proto.String("Requests."),
+		Type: clientmodel.MetricType_COUNTER.Enum(),
+	}
+	for _, code := range []string{"200", "404", "500"} {
+		mf.Metric = append(mf.Metric, &clientmodel.Metric{
+			Label:   []*clientmodel.LabelPair{{Name: proto.String("code"), Value: proto.String(code)}},
+			Counter: &clientmodel.Counter{Value: proto.Float64(1)},
+		})
+	}
+	families := relabelFamily(mf, &relabeler{cfgs: mustRelabelConfigs(t, `
+- {source_labels: [code], regex: "4..", action: drop}
+- {source_labels: [__name__, code], regex: "(.*)_total;5..", target_label: __name__, replacement: "${1}_errors_total"}`)})
+	if !assert.Len(t, families, 2) {
+		return
+	}
+	assert.Equal(t, "requests_total", families[0].GetName())
+	assert.Equal(t, "200", families[0].Metric[0].Label[0].GetValue())
+	assert.Equal(t, "requests_errors_total", families[1].GetName())
+	assert.Equal(t, clientmodel.MetricType_COUNTER, families[1].GetType())
+	assert.Equal(t, "500", families[1].Metric[0].Label[0].GetValue())
+}
+
+func TestRelabelFamilySeries(t *testing.T) {
+	histogram := func() *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name: proto.String("latency_seconds"),
+			Help: proto.String("Latency."),
+			Type: clientmodel.MetricType_HISTOGRAM.Enum(),
+			Metric: []*clientmodel.Metric{{
+				Label: []*clientmodel.LabelPair{{Name: proto.String("path"), Value: proto.String("/")}},
+				Histogram: &clientmodel.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(1.5),
+					Bucket: []*clientmodel.Bucket{
+						{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(1)},
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+					},
+				},
+			}},
+		}
+	}
+	type sample struct {
+		name, labels string
+		value        float64
+	}
+	samples := func(families []*clientmodel.MetricFamily) []sample {
+		var ss []sample
+		for _, f := range families {
+			assert.Equal(t, clientmodel.MetricType_UNTYPED, f.GetType(), f.GetName())
+			for _, m := range f.Metric {
+				var labels []string
+				for _, l := range m.Label {
+					labels = append(labels, l.GetName()+"="+l.GetValue())
+				}
+				ss = append(ss, sample{f.GetName(), strings.Join(labels, ","), m.GetUntyped().GetValue()})
+			}
+		}
+		return ss
+	}
+
+	// renaming all series keeps the histogram
+	families := relabelFamily(histogram(), &relabeler{cfgs: mustRelabelConfigs(t, `
+- {source_labels: [__name__], regex: "latency_seconds(_.*)", target_label: __name__, replacement: "http_latency_seconds$1"}
+- {target_label: service, replacement: web}`)})
+	if assert.Len(t, families, 1) {
+		assert.Equal(t, "http_latency_seconds", families[0].GetName())
+		assert.Equal(t, clientmodel.MetricType_HISTOGRAM, families[0].GetType())
+		assert.Equal(t, "Latency.", families[0].GetHelp())
+		assert.Len(t, families[0].Metric[0].Label, 2)
+		assert.Len(t, families[0].Metric[0].Histogram.Bucket, 2)
+	}
+
+	// the rules match the series, like on text expositions
+	families = relabelFamily(histogram(), &relabeler{cfgs: mustRelabelConfigs(t, `
+- {source_labels: [__name__], regex: "latency_seconds", action: drop}`)})
+	assert.Len(t, families, 1)
+	assert.Equal(t, clientmodel.MetricType_HISTOGRAM, families[0].GetType())
+
+	families = relabelFamily(histogram(), &relabeler{cfgs: mustRelabelConfigs(t, `
+- {source_labels: [__name__, le], regex: "latency_seconds_bucket;1", action: drop}`)})
+	assert.Equal(t, []sample{
+		{"latency_seconds_bucket", "path=/,le=0.1", 1},
+		{"latency_seconds_bucket", "path=/,le=+Inf", 3},
+		{"latency_seconds_sum", "path=/", 1.5},
+		{"latency_seconds_count", "path=/", 3},
+	}, samples(families))
+
+	summary := &clientmodel.MetricFamily{
+		Name: proto.String("rpc_seconds"),
+		Type: clientmodel.MetricType_SUMMARY.Enum(),
+		Metric: []*clientmodel.Metric{{
+			Summary: &clientmodel.Summary{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(2),
+				Quantile:    []*clientmodel.Quantile{{Quantile: proto.Float64(0.99), Value: proto.Float64(0.5)}},
+			},
+		}},
+	}
+	families = relabelFamily(summary, &relabeler{cfgs: mustRelabelConfigs(t, `
+- {source_labels: [__name__], regex: "rpc_seconds", action: drop}`)})
+	assert.Equal(t, []sample{
+		{"rpc_seconds_sum", "", 2},
+		{"rpc_seconds_count", "", 10},
+	}, samples(families))
+}
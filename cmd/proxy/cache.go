@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of scrapes served through the cache.
+const (
+	cacheMiss  = "miss"  // scraped the client
+	cacheHit   = "hit"   // shared the scrape of a concurrent or recent request
+	cacheStale = "stale" // the scrape failed, served the last successful response
+)
+
+var cacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: namespace + "_cache_requests_total",
+		Help: "Scrapes served through the cache by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests)
+}
+
+// scrapeCache coalesces the scrapes of a target within window into one scrape of the client,
+// i.e. the scrapes of Prometheus HA pairs. With staleIfError set, a failed scrape is answered with
+// the last successful response up to that age.
+type scrapeCache struct {
+	window       time.Duration
+	staleIfError time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+	lastSweep time.Time
+}
+
+type cacheEntry struct {
+	done    chan struct{} // closed once resp is set
+	resp    *bufferedResponse
+	fetched time.Time
+
+	// the shared scrape is canceled once every waiter went away or the last deadline of
+	// the waiters passed
+	waiters  int
+	canceled bool // by the last waiter going away, the entry isn't shared anymore
+	deadline time.Time
+	timer    *time.Timer
+	cancel   context.CancelFunc
+
+	// the last successful response, kept across scrapes for staleIfError
+	good        *bufferedResponse
+	goodFetched time.Time
+}
+
+func newScrapeCache(window, staleIfError time.Duration) *scrapeCache {
+	return &scrapeCache{window: window, staleIfError: staleIfError, entries: map[string]*cacheEntry{}}
+}
+
+// cacheKey identifies the scrapes sharing a response, the target and the headers selecting the format.
+func cacheKey(r *http.Request) string {
+	return r.Host + " " + r.URL.RequestURI() + " " + r.Header.Get("Accept") + " " + r.Header.Get("Accept-Encoding")
+}
+
+// serve answers r through the cache, scrape scrapes the client.
+func (c *scrapeCache) serve(w http.ResponseWriter, r *http.Request, scrape http.HandlerFunc) {
+	key := cacheKey(r)
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && (e.resp == nil && !e.canceled || e.resp != nil && now.Sub(e.fetched) < c.window) {
+		pending := e.resp == nil
+		if pending {
+			e.join(now, r)
+		}
+		c.mu.Unlock()
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			if pending {
+				c.leave(e)
+			}
+			return
+		}
+		c.write(w, e, cacheHit)
+		return
+	}
+	next := &cacheEntry{done: make(chan struct{})}
+	if ok {
+		next.good, next.goodFetched = e.good, e.goodFetched
+	}
+	// the scrape is shared, it must not be canceled by this request going away
+	ctx, cancel := context.WithCancel(context.Background())
+	next.cancel = cancel
+	next.timer = time.AfterFunc(time.Hour, cancel)
+	next.join(now, r)
+	c.entries[key] = next
+	c.sweep(now)
+	c.mu.Unlock()
+
+	left := context.AfterFunc(r.Context(), func() { c.leave(next) })
+	rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+	sr := r.Clone(ctx)
+	sr.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(time.Until(next.deadline).Seconds(), 'f', 3, 64))
+	scrape(rec, sr)
+	left()
+
+	c.mu.Lock()
+	next.resp, next.fetched = rec, time.Now()
+	if rec.code == http.StatusOK {
+		next.good, next.goodFetched = rec, next.fetched
+	}
+	if next.canceled {
+		// nobody waits for it anymore, the next request scrapes again
+		next.fetched = time.Time{}
+	}
+	next.timer.Stop()
+	c.mu.Unlock()
+	cancel()
+	close(next.done)
+	c.write(w, next, cacheMiss)
+}
+
+// join adds r as waiter for the pending scrape of e, extending its deadline to the
+// scrape timeout of r. c.mu must be held.
+func (e *cacheEntry) join(now time.Time, r *http.Request) {
+	e.waiters++
+	deadline := now.Add(util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header))
+	if deadline.After(e.deadline) {
+		e.deadline = deadline
+		e.timer.Reset(deadline.Sub(now))
+	}
+}
+
+// leave drops a waiter for the pending scrape of e, the scrape is canceled with the last one
+// and later requests don't join it anymore.
+func (c *scrapeCache) leave(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.waiters--
+	if e.waiters == 0 && e.resp == nil {
+		e.canceled = true
+		e.cancel()
+	}
+}
+
+// write answers with the response of e, or the last successful one if it failed and that is recent enough.
+func (c *scrapeCache) write(w http.ResponseWriter, e *cacheEntry, result string) {
+	c.mu.Lock()
+	resp, fetched := e.resp, e.fetched
+	if resp.code != http.StatusOK && e.good != nil && time.Since(e.goodFetched) <= c.staleIfError {
+		resp, fetched, result = e.good, e.goodFetched, cacheStale
+	}
+	c.mu.Unlock()
+
+	cacheRequests.WithLabelValues(result).Inc()
+	for k, v := range resp.header {
+		w.Header()[k] = v
+	}
+	if result != cacheMiss {
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(fetched).Seconds())))
+	}
+	w.WriteHeader(resp.code)
+	w.Write(resp.body.Bytes())
+}
+
+// sweep drops the entries that can't be served anymore, at most once per retention.
+// c.mu must be held.
+func (c *scrapeCache) sweep(now time.Time) {
+	retention := c.window
+	if c.staleIfError > retention {
+		retention = c.staleIfError
+	}
+	if now.Sub(c.lastSweep) < retention {
+		return
+	}
+	c.lastSweep = now
+	for key, e := range c.entries {
+		if e.resp != nil && now.Sub(e.fetched) > retention && now.Sub(e.goodFetched) > retention {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeCache(t *testing.T) {
+	c := newScrapeCache(50*time.Millisecond, 200*time.Millisecond)
+	var scrapes int
+	started, release := make(chan struct{}), make(chan struct{})
+	fail := false
+	scrape := func(w http.ResponseWriter, r *http.Request) {
+		scrapes++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		started <- struct{}{}
+		<-release
+		fmt.Fprintf(w, "up %d\n", scrapes)
+	}
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c.serve(rec, httptest.NewRequest("GET", "http://node.client:80/metrics", nil), scrape)
+		return rec
+	}
+
+	// concurrent scrapes share one scrape of the client
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		recs[0] = get()
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		recs[1] = get()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, rec := range recs {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "up 1\n", rec.Body.String())
+	}
+	assert.Equal(t, 1, scrapes)
+
+	// so do scrapes within the window
+	rec := get()
+	assert.Equal(t, "up 1\n", rec.Body.String())
+	assert.Equal(t, "0", rec.Header().Get("Age"))
+	assert.Equal(t, 1, scrapes)
+
+	// a failed scrape is answered with the last successful response
+	time.Sleep(60 * time.Millisecond)
+	fail = true
+	rec = get()
+	assert.Equal(t, 2, scrapes)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "up 1\n", rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Get("Age"))
+
+	// up to staleIfError
+	time.Sleep(200 * time.Millisecond)
+	rec = get()
+	assert.Equal(t, 3, scrapes)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestScrapeCacheCancel(t *testing.T) {
+	c := newScrapeCache(time.Minute, 0)
+	canceled := make(chan time.Duration, 1)
+	timeouts := make(chan float64, 1)
+	hold := make(chan struct{})
+	scrape := func(w http.ResponseWriter, r *http.Request) {
+		timeout, _ := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+		timeouts <- timeout
+		start := time.Now()
+		<-r.Context().Done()
+		canceled <- time.Since(start)
+		<-hold
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	get := func(ctx context.Context, timeout string) chan int {
+		code := make(chan int, 1)
+		r := httptest.NewRequest("GET", "http://node.client:80/metrics", nil).WithContext(ctx)
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", timeout)
+		go func() {
+			rec := httptest.NewRecorder()
+			c.serve(rec, r, scrape)
+			code <- rec.Code
+		}()
+		return code
+	}
+
+	// the shared scrape is canceled once every waiter went away
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	get(ctx1, "60")
+	timeout := <-timeouts
+	assert.True(t, timeout > 59 && timeout <= 60, timeout)
+	get(ctx2, "60")
+	time.Sleep(10 * time.Millisecond)
+	cancel1()
+	select {
+	case <-canceled:
+		t.Fatal("scrape canceled while a request still waits for it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel2()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("scrape not canceled")
+	}
+
+	// a request arriving before the canceled scrape returned doesn't join it
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	get(ctx3, "30")
+	select {
+	case timeout = <-timeouts:
+		assert.True(t, timeout > 29 && timeout <= 30, timeout)
+	case <-time.After(time.Second):
+		t.Fatal("joined the canceled scrape")
+	}
+	cancel3()
+	<-canceled
+	close(hold)
+
+	// and bounded by the largest scrape timeout of the waiters
+	code := get(context.Background(), "0.05")
+	<-timeouts
+	get(context.Background(), "0.2")
+	took := <-canceled
+	assert.True(t, took > 150*time.Millisecond && took < time.Second, took)
+	assert.Equal(t, http.StatusServiceUnavailable, <-code)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tunnelCompressedBytesDesc = prometheus.NewDesc(
+		namespace+"_tunnel_compressed_bytes_total",
+		"Bytes of scrape bodies compressed in the tunnel of a client.",
+		[]string{"fqdn"}, nil,
+	)
+	tunnelUncompressedBytesDesc = prometheus.NewDesc(
+		namespace+"_tunnel_uncompressed_bytes_total",
+		"Bytes of scrape bodies compressed in the tunnel of a client, after decompression.",
+		[]string{"fqdn"}, nil,
+	)
+	tunnelCompressionRatioDesc = prometheus.NewDesc(
+		namespace+"_tunnel_compression_ratio",
+		"Ratio of uncompressed to compressed bytes of scrape bodies in the tunnel of a client.",
+		[]string{"fqdn"}, nil,
+	)
+
+	// tunnelCompression holds the compression statistics of the clients
+	tunnelCompression = newCompressionStats()
+)
+
+func init() {
+	prometheus.MustRegister(tunnelCompression)
+}
+
+type compressionStat struct {
+	compressed, uncompressed int64
+}
+
+// compressionStats accounts the scrape bodies compressed in the tunnels by fqdn.
+type compressionStats struct {
+	mu      sync.Mutex
+	clients map[string]*compressionStat
+}
+
+func newCompressionStats() *compressionStats {
+	return &compressionStats{clients: map[string]*compressionStat{}}
+}
+
+func (s *compressionStats) record(fqdn string, compressed, uncompressed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.clients[fqdn]
+	if !ok {
+		st = &compressionStat{}
+		s.clients[fqdn] = st
+	}
+	st.compressed += compressed
+	st.uncompressed += uncompressed
+}
+
+func (s *compressionStats) forget(fqdn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, fqdn)
+}
+
+// Describe implements prometheus.Collector.
+func (s *compressionStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelCompressedBytesDesc
+	ch <- tunnelUncompressedBytesDesc
+	ch <- tunnelCompressionRatioDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *compressionStats) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for fqdn, st := range s.clients {
+		ch <- prometheus.MustNewConstMetric(tunnelCompressedBytesDesc, prometheus.CounterValue, float64(st.compressed), fqdn)
+		ch <- prometheus.MustNewConstMetric(tunnelUncompressedBytesDesc, prometheus.CounterValue, float64(st.uncompressed), fqdn)
+		if st.compressed > 0 {
+			ch <- prometheus.MustNewConstMetric(tunnelCompressionRatioDesc, prometheus.GaugeValue, float64(st.uncompressed)/float64(st.compressed), fqdn)
+		}
+	}
+}
+
+// writeResponse writes resp to w. A body compressed for the tunnel is decompressed, and compressed with gzip
+// again if the scrape accepts it.
+func (c *Coordinator) writeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) (int64, error) {
+	compression := resp.Header.Get(util.TunnelEncodingHeader)
+	resp.Header.Del(util.TunnelEncodingHeader)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if compression == "" {
+		w.WriteHeader(resp.StatusCode)
+		return io.Copy(w, resp.Body)
+	}
+
+	compressed := &countingReader{r: resp.Body}
+	body, err := util.NewDecompressReader(compressed, compression)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return 0, err
+	}
+	defer body.Close()
+	w.Header().Del("Content-Length")
+	out := io.Writer(w)
+	var gw *gzip.Writer
+	if acceptsGzip(r.Header) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw = gzip.NewWriter(w)
+		out = gw
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, err := io.Copy(out, body)
+	if gw != nil {
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	tunnelCompression.record(c.fqdn, compressed.n, n)
+	return n, err
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, enc := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		return len(parts) == 1 || strings.TrimSpace(parts[1]) != "q=0"
+	}
+	return false
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
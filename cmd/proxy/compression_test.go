@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelCompression(t *testing.T) {
+	c := newCoordinator(log.NewNopLogger(), "compressed.example", "", newTicket(), 0, newRegistry())
+	defer tunnelCompression.forget(c.fqdn)
+	text := strings.Repeat("http_requests_total{code=\"200\"} 1027\n", 100)
+	response := func() *http.Response {
+		var buf bytes.Buffer
+		w, _ := zstd.NewWriter(&buf)
+		w.Write([]byte(text))
+		w.Close()
+		header := http.Header{}
+		header.Set(util.TunnelEncodingHeader, util.CompressionZstd)
+		header.Set("Content-Type", "text/plain; version=0.0.4")
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(&buf)}
+	}
+
+	// re-encoded with gzip for Prometheus
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://node.compressed.example:80/metrics", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	n, err := c.writeResponse(rec, r, response())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(text)), n)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get(util.TunnelEncodingHeader))
+	gr, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(gr)
+		assert.Equal(t, text, string(b))
+	}
+
+	// and sent as is otherwise
+	rec = httptest.NewRecorder()
+	r.Header.Set("Accept-Encoding", "gzip;q=0, identity")
+	_, err = c.writeResponse(rec, r, response())
+	assert.NoError(t, err)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, text, rec.Body.String())
+
+	tunnelCompression.mu.Lock()
+	st := *tunnelCompression.clients[c.fqdn]
+	tunnelCompression.mu.Unlock()
+	assert.Equal(t, int64(2*len(text)), st.uncompressed)
+	assert.Less(t, st.compressed, st.uncompressed/10)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// handleConnect serves CONNECT <process_name>.<fqdn>:443, the tunnel of a https scrape.
+// With a certificate configured TLS is terminated and the tunneled requests are scraped like
+// plain proxy requests, otherwise the tunnel is passed through to the https endpoint on the client.
+func (h *httpHandler) handleConnect(w http.ResponseWriter, r *http.Request) {
+	c, code := h.resolve(r)
+	if c == nil {
+		w.WriteHeader(code)
+		return
+	}
+	if h.s.tlsConfig == nil {
+		c.handleTunnel(w, r)
+		return
+	}
+
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		level.Error(h.logger).Log("msg", "failed to hijack CONNECT", "err", err)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	target := r.Host
+	srv := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Host, r.URL.Host, r.URL.Scheme = target, target, "https"
+		h.proxy.ServeHTTP(w, r)
+	}))
+	srv.Serve(newConnListener(tls.Server(&bufferedConn{Conn: conn, r: brw.Reader}, h.s.tlsConfig)))
+}
+
+// handleTunnel passes the CONNECT tunnel r through to the client, which pipes it to the endpoint.
+// The scrapes in the tunnel can't be told apart, so the tunnel is accounted as one scrape: it holds
+// a slot of the scrape limiters while it's open, and it's closed once idle for the default scrape
+// timeout, so that tunnels Prometheus keeps open between scrapes don't hold on to their slots.
+func (c *Coordinator) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if err := c.acquireScrape(r.Context(), start.Add(*defaultScrapeTimeout)); err != nil {
+		level.Debug(c.lg).Log("msg", "tunnel not admitted", "fqdn", c.fqdn, "err", err)
+		code, _ := strconv.Atoi(*limitRejectStatus)
+		w.WriteHeader(code)
+		c.recordScrape(r.Host, start, 0, stageQueue, err)
+		return
+	}
+	defer c.releaseScrape()
+
+	rwc, err := c.getScrapeConn(*defaultScrapeTimeout - time.Since(start))
+	if err != nil {
+		level.Debug(c.lg).Log("msg", "failed to get scrape connection", "fqdn", c.fqdn, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		c.recordScrape(r.Host, start, 0, stageTunnel, err)
+		return
+	}
+	// the scrape connection carries the tunnel from now on, it's never given back
+	defer rwc.Close()
+
+	req := &http.Request{Method: http.MethodConnect, URL: r.URL, Host: r.Host, Header: http.Header{}}
+	if err := req.Write(rwc); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		c.recordScrape(r.Host, start, 0, stageRequest, err)
+		return
+	}
+	br := bufio.NewReader(rwc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		c.recordScrape(r.Host, start, 0, stageResponse, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		n, _ := io.Copy(w, resp.Body)
+		c.recordScrape(r.Host, start, n, stageStatus, fmt.Errorf("server returned HTTP status %s", resp.Status))
+		return
+	}
+
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		level.Error(c.lg).Log("msg", "failed to hijack CONNECT", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	n := pipe(&bufferedConn{Conn: conn, r: brw.Reader}, &bufferedConn{Conn: rwc, r: br}, *defaultScrapeTimeout)
+	c.recordScrape(r.Host, start, n, "", nil)
+}
+
+// pipe copies between a and b until either side is done or nothing was copied for idle, then closes both.
+// It returns the number of bytes copied from b to a.
+func pipe(a, b net.Conn, idle time.Duration) int64 {
+	var active int64 = time.Now().UnixNano() // accessed atomically
+	done, stop := make(chan struct{}, 2), make(chan struct{})
+	var n int64
+	cp := func(dst, src net.Conn, n *int64) {
+		*n, _ = io.Copy(&activeWriter{w: dst, active: &active}, src)
+		done <- struct{}{}
+	}
+	go cp(a, b, &n)
+	go cp(b, a, new(int64))
+	go func() {
+		t := time.NewTimer(idle)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if d := time.Since(time.Unix(0, atomic.LoadInt64(&active))); d < idle {
+					t.Reset(idle - d)
+					continue
+				}
+				a.Close()
+				b.Close()
+			case <-stop:
+			}
+			return
+		}
+	}()
+	<-done
+	close(stop)
+	a.Close()
+	b.Close()
+	<-done
+	return n
+}
+
+// activeWriter records the time of the last write in active.
+type activeWriter struct {
+	w      io.Writer
+	active *int64
+}
+
+func (w *activeWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(w.active, time.Now().UnixNano())
+	return w.w.Write(p)
+}
+
+// bufferedConn reads what was buffered while reading the CONNECT handshake before reading from Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener accepts a single connection, Accept blocks until it's closed afterwards.
+type connListener struct {
+	conn      net.Conn
+	accepted  sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.accepted.Do(func() {
+		conn = &closeNotifyConn{Conn: l.conn, l: l}
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, errors.New("connection closed")
+}
+
+func (l *connListener) Close() error {
+	l.close()
+	return nil
+}
+
+func (l *connListener) close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.l.close()
+	return err
+}
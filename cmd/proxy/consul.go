@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	consulDefaultWait = 5 * time.Minute
+	consulMaxWait     = 10 * time.Minute
+)
+
+// consulAPI serves the subset of the Consul HTTP API that consul_sd_configs of Prometheus uses.
+// Every process is a service, its instances are the clients registering it: the node is the
+// fqdn of the client and the service address <process_name>.<fqdn>:80. The registry version
+// is the Consul index of blocking queries.
+type consulAPI struct {
+	reg        *registry
+	datacenter string
+}
+
+func newConsulAPI(reg *registry, datacenter string) *consulAPI {
+	return &consulAPI{reg: reg, datacenter: datacenter}
+}
+
+func (a *consulAPI) handlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/v1/agent/self":       a.handleAgentSelf,
+		"/v1/catalog/services": a.handleServices,
+		"/v1/catalog/service/": a.handleCatalogService,
+		"/v1/health/service/":  a.handleHealthService,
+	}
+}
+
+type consulNode struct {
+	ID              string
+	Node            string
+	Address         string
+	Datacenter      string
+	TaggedAddresses map[string]string
+	Meta            map[string]string
+}
+
+type consulService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Address string
+	Meta    map[string]string
+	Port    int
+}
+
+type consulCheck struct {
+	Node        string
+	CheckID     string
+	Name        string
+	Status      string
+	ServiceID   string
+	ServiceName string
+}
+
+type consulServiceEntry struct {
+	Node    *consulNode
+	Service *consulService
+	Checks  []*consulCheck
+}
+
+type consulCatalogService struct {
+	ID              string
+	Node            string
+	Address         string
+	Datacenter      string
+	TaggedAddresses map[string]string
+	NodeMeta        map[string]string
+	ServiceID       string
+	ServiceName     string
+	ServiceTags     []string
+	ServiceAddress  string
+	ServicePort     int
+	ServiceMeta     map[string]string
+}
+
+// handleAgentSelf tells Prometheus the datacenter when its config lacks one.
+func (a *consulAPI) handleAgentSelf(w http.ResponseWriter, r *http.Request) {
+	writeConsulJSON(w, map[string]interface{}{
+		"Config": map[string]interface{}{
+			"Datacenter": a.datacenter,
+			"NodeName":   "pushprox",
+		},
+	})
+}
+
+func (a *consulAPI) handleServices(w http.ResponseWriter, r *http.Request) {
+	targets, ok := a.block(w, r)
+	if !ok {
+		return
+	}
+	services := map[string][]string{}
+	for _, t := range targets {
+		services[t.Process] = mergeTags(services[t.Process], consulTags(t))
+	}
+	writeConsulJSON(w, services)
+}
+
+func (a *consulAPI) handleCatalogService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+	targets, ok := a.block(w, r)
+	if !ok {
+		return
+	}
+	instances := []*consulCatalogService{}
+	for _, t := range a.instances(targets, name, r.URL.Query()["tag"]) {
+		e := a.entry(t)
+		instances = append(instances, &consulCatalogService{
+			ID:              e.Node.ID,
+			Node:            e.Node.Node,
+			Address:         e.Node.Address,
+			Datacenter:      e.Node.Datacenter,
+			TaggedAddresses: e.Node.TaggedAddresses,
+			NodeMeta:        e.Node.Meta,
+			ServiceID:       e.Service.ID,
+			ServiceName:     e.Service.Service,
+			ServiceTags:     e.Service.Tags,
+			ServiceAddress:  e.Service.Address,
+			ServicePort:     e.Service.Port,
+			ServiceMeta:     e.Service.Meta,
+		})
+	}
+	writeConsulJSON(w, instances)
+}
+
+func (a *consulAPI) handleHealthService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	targets, ok := a.block(w, r)
+	if !ok {
+		return
+	}
+	_, passingOnly := r.URL.Query()["passing"]
+	entries := []*consulServiceEntry{}
+	for _, t := range a.instances(targets, name, r.URL.Query()["tag"]) {
+		e := a.entry(t)
+		if passingOnly && e.Checks[0].Status != "passing" {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	writeConsulJSON(w, entries)
+}
+
+// block answers blocking queries: if the index parameter is the current registry version,
+// it waits for a change up to the wait parameter. It returns the listed targets.
+func (a *consulAPI) block(w http.ResponseWriter, r *http.Request) ([]*Target, bool) {
+	q := r.URL.Query()
+	if index := q.Get("index"); index != "" {
+		lastIndex, err := strconv.ParseUint(index, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid index %q", index), http.StatusBadRequest)
+			return nil, false
+		}
+		wait := consulDefaultWait
+		if s := q.Get("wait"); s != "" {
+			if wait, err = time.ParseDuration(s); err != nil {
+				http.Error(w, fmt.Sprintf("invalid wait %q", s), http.StatusBadRequest)
+				return nil, false
+			}
+		}
+		if wait > consulMaxWait {
+			wait = consulMaxWait
+		}
+		changed := a.reg.Changed()
+		if lastIndex == a.index() {
+			timer := time.NewTimer(wait)
+			select {
+			case <-changed:
+			case <-timer.C:
+			case <-r.Context().Done():
+			}
+			timer.Stop()
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(a.index(), 10))
+	w.Header().Set("X-Consul-Knownleader", "true")
+	w.Header().Set("X-Consul-Lastcontact", "0")
+	return listedTargets(a.reg.Targets(), false), true
+}
+
+// index returns the registry version as Consul index, which starts at 1.
+func (a *consulAPI) index() uint64 {
+	return a.reg.Version() + 1
+}
+
+// instances returns the targets of service name carrying all tags.
+func (a *consulAPI) instances(targets []*Target, name string, tags []string) []*Target {
+	var instances []*Target
+	for _, t := range targets {
+		if t.Process != name || !hasTags(consulTags(t), tags) {
+			continue
+		}
+		instances = append(instances, t)
+	}
+	return instances
+}
+
+func (a *consulAPI) entry(t *Target) *consulServiceEntry {
+	meta := map[string]string{
+		"pushprox_fqdn":    t.Fqdn,
+		"pushprox_process": t.Process,
+	}
+	if t.Client.RemoteAddr != "" {
+		meta["pushprox_client_address"] = t.Client.RemoteAddr
+	}
+	if t.Client.TokenID != "" {
+		meta["pushprox_token_id"] = t.Client.TokenID
+	}
+	if t.Client.Version != "" {
+		meta["pushprox_client_version"] = t.Client.Version
+	}
+	if !t.Client.ConnectedAt.IsZero() {
+		meta["pushprox_connected_at"] = t.Client.ConnectedAt.UTC().Format(time.RFC3339)
+	}
+	for k, v := range t.Labels {
+		meta[k] = v
+	}
+	status := "passing"
+	if t.Stale {
+		status = "warning"
+	}
+	id := t.Process + "." + t.Fqdn
+	return &consulServiceEntry{
+		Node: &consulNode{
+			ID:         t.Fqdn,
+			Node:       t.Fqdn,
+			Address:    t.Fqdn,
+			Datacenter: a.datacenter,
+			Meta:       map[string]string{},
+		},
+		Service: &consulService{
+			ID:      id,
+			Service: t.Process,
+			Tags:    consulTags(t),
+			Address: id,
+			Meta:    meta,
+			Port:    80,
+		},
+		Checks: []*consulCheck{{
+			Node:        t.Fqdn,
+			CheckID:     "pushprox:" + id,
+			Name:        "PushProx registration",
+			Status:      status,
+			ServiceID:   id,
+			ServiceName: t.Process,
+		}},
+	}
+}
+
+// consulTags returns the labels registered for t as name=value tags.
+func consulTags(t *Target) []string {
+	tags := make([]string, 0, len(t.Labels))
+	for k, v := range t.Labels {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func hasTags(tags, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeTags(tags, more []string) []string {
+	if tags == nil {
+		tags = []string{}
+	}
+	for _, t := range more {
+		if !hasTags(tags, []string{t}) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func writeConsulJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
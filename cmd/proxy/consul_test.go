@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsulAPI(t *testing.T) {
+	reg := newRegistry()
+	c := newCoordinator(log.NewNopLogger(), "client", "", newTicket(), 0, reg)
+	reg.update("client", func(*Coordinator) *Coordinator { return c })
+	c.addScrapeTarget("node", map[string]string{"team": "infra"})
+	c.addScrapeTarget("app", nil)
+	h := newHttpHandler(&server{reg: reg}, log.NewNopLogger())
+
+	get := func(url string, v interface{}) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, 200, rec.Code, url)
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(v), url)
+		return rec.Header().Get("X-Consul-Index")
+	}
+
+	var self map[string]map[string]interface{}
+	get("/v1/agent/self", &self)
+	assert.Equal(t, "dc1", self["Config"]["Datacenter"])
+
+	var services map[string][]string
+	index := get("/v1/catalog/services", &services)
+	assert.Equal(t, map[string][]string{"node": {"team=infra"}, "app": {}}, services)
+
+	var entries []*consulServiceEntry
+	get("/v1/health/service/node?tag=team=infra&passing", &entries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "client", entries[0].Node.Node)
+		assert.Equal(t, "node.client", entries[0].Service.Address)
+		assert.Equal(t, 80, entries[0].Service.Port)
+		assert.Equal(t, "infra", entries[0].Service.Meta["team"])
+		assert.Equal(t, "client", entries[0].Service.Meta["pushprox_fqdn"])
+	}
+	get("/v1/health/service/app?tag=team=infra", &entries)
+	assert.Empty(t, entries)
+
+	var instances []*consulCatalogService
+	get("/v1/catalog/service/app", &instances)
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, "app.client", instances[0].ServiceAddress)
+	}
+
+	// a blocking query returns once the registry changes
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.addScrapeTarget("db", nil)
+	}()
+	start := time.Now()
+	next := get("/v1/catalog/services?index="+index+"&wait=5s", &services)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.NotEqual(t, index, next)
+	assert.Contains(t, services, "db")
+
+	// and returns at once for an outdated index
+	start = time.Now()
+	get("/v1/catalog/services?index="+index+"&wait=5s", &services)
+	assert.True(t, time.Since(start) < time.Second)
+
+	start = time.Now()
+	get("/v1/catalog/services?index="+next+"&wait=50ms", &services)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
@@ -2,88 +2,450 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/common/model"
 )
 
+// Coordinator serves the targets of one client. It outlives the control connection of the
+// client for a grace period, so a client reconnecting with its ticket keeps its targets.
 type Coordinator struct {
-	lg   log.Logger
-	fqdn string
+	lg    log.Logger
+	fqdn  string
+	grace time.Duration
+	reg   *registry
+	done  chan struct{}
 
-	mu      sync.Mutex // guard stopped, known
-	stopped bool
-	known   map[string]time.Time
+	limiter *scrapeLimiter // of the scrapes of this client, nil if unlimited
 
+	wmu sync.Mutex // serialize writes to the control connection
+
+	mu           sync.Mutex // guard all below
+	token        string
+	ticket       string
+	restored     bool // restored from the persisted state and not adopted by a client yet
+	stopped      bool
+	known        map[string]*lease // by process name
+	leaseTTL     time.Duration     // 0 if the client doesn't renew its registrations
+	client       clientInfo        // of the last attached control connection
 	ctlConn      net.Conn
+	greeted      bool // the client was told about its session on ctlConn
 	scrapeConnCh chan net.Conn
+	attached     chan struct{} // closed while a greeted control connection is attached
+	expiry       *time.Timer
+}
+
+// clientInfo describes the connection of a client.
+type clientInfo struct {
+	RemoteAddr  string
+	TokenID     string
+	Version     string
+	ConnectedAt time.Time
+}
+
+// lease is the registration of a process.
+type lease struct {
+	labels   map[string]string // registered by the client
+	renewed  time.Time
+	stale    bool // set once the lapse of the lease was noticed
+	restored bool // restored from the persisted state and not registered again yet
+}
+
+func newCoordinator(lg log.Logger, fqdn, token, ticket string, grace time.Duration, reg *registry) *Coordinator {
+	return &Coordinator{
+		lg:       lg,
+		fqdn:     fqdn,
+		grace:    grace,
+		token:    token,
+		ticket:   ticket,
+		reg:      reg,
+		done:     make(chan struct{}),
+		limiter:  newScrapeLimiter(scopeClient, *clientMaxInflight, *clientMaxQueue),
+		known:    map[string]*lease{},
+		attached: make(chan struct{}),
+	}
+}
+
+// newTicket returns a random resumption ticket.
+func newTicket() string {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
 
-func (c *Coordinator) addScrapeTarget(fqdn string) {
+// resumable reports whether a client presenting token and ticket may reattach to c.
+func (c *Coordinator) resumable(token, ticket string) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return ticket != "" && c.token == token &&
+		subtle.ConstantTimeCompare([]byte(c.ticket), []byte(ticket)) == 1
+}
+
+// restore adds targets last seen before a restart of the proxy. They are served as stale
+// until the client registers them again, and dropped after period otherwise.
+func (c *Coordinator) restore(targets []*persistedTarget, period time.Duration) {
+	c.mu.Lock()
+	c.restored = true
+	for _, t := range targets {
+		c.known[t.Process] = &lease{labels: t.Labels, renewed: t.LastSeen, stale: true, restored: true}
+	}
+	c.expiry = time.AfterFunc(period, c.stop)
+	c.mu.Unlock()
 
-	c.known[fqdn] = time.Now()
-	knownTargets.Set(float64(len(c.known)))
+	c.reg.targetsChanged(len(targets))
+	time.AfterFunc(period, c.dropRestoredTargets)
 }
 
-func (c *Coordinator) delScrapeTarget(fqdn string) {
+// adopt hands a restored coordinator to the first client connecting with its fqdn.
+func (c *Coordinator) adopt(token, ticket string) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if !c.restored || c.stopped {
+		return false
+	}
+	c.restored = false
+	c.token, c.ticket = token, ticket
+	return true
+}
 
-	delete(c.known, fqdn)
-	knownTargets.Set(float64(len(c.known)))
+// dropRestoredTargets forgets the restored targets the client didn't register again.
+func (c *Coordinator) dropRestoredTargets() {
+	c.mu.Lock()
+	var dropped int
+	for process, l := range c.known {
+		if l.restored {
+			delete(c.known, process)
+			targetStats.forget(c.fqdn, process)
+			dropped++
+		}
+	}
+	c.mu.Unlock()
+
+	if dropped > 0 {
+		c.reg.targetsChanged(-dropped)
+	}
 }
 
-// KnownTargets returns a list of available targets
-func (c *Coordinator) KnownTargets() []string {
+// attach makes conn the control connection of c and returns the ticket of c, the caller
+// tells the client about its session with greet. A previously attached control connection
+// is closed, by its greet if it wasn't greeted yet.
+func (c *Coordinator) attach(conn net.Conn, leaseTTL time.Duration, client clientInfo) (string, bool) {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return "", false
+	}
+	c.leaseTTL = leaseTTL
+	c.client = client
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	oldConn, oldCh, greeted := c.ctlConn, c.scrapeConnCh, c.greeted
+	c.ctlConn = conn
+	c.scrapeConnCh = make(chan net.Conn, 10)
+	if c.greeted {
+		c.greeted = false
+		c.attached = make(chan struct{})
+	}
+	ticket := c.ticket
+	c.mu.Unlock()
+
+	if oldConn != nil && greeted {
+		oldConn.Close()
+	}
+	closeScrapeConns(oldCh)
+	return ticket, true
+}
+
+// greet sends msg as the first message on conn attached with attach, and starts serving it.
+// Scrapes don't request connections on conn before. If conn was replaced or c stopped
+// meanwhile, conn is closed after msg was sent.
+func (c *Coordinator) greet(conn net.Conn, typ util.MsgType, msg []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(connReadTimeout))
+	err := c.writeCtl(conn, typ, msg)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	current := c.ctlConn == conn
+	if current {
+		c.greeted = true
+		close(c.attached)
+	}
+	c.mu.Unlock()
+	if !current {
+		conn.Close()
+		return nil
+	}
+	go c.start(conn)
+	return nil
+}
+
+// detach drops conn as control connection, c is stopped if the client doesn't
+// reattach within the grace period.
+func (c *Coordinator) detach(conn net.Conn) {
+	conn.Close()
+
+	c.mu.Lock()
+	if c.stopped || c.ctlConn != conn {
+		c.mu.Unlock()
+		return
+	}
+	ch := c.scrapeConnCh
+	c.ctlConn, c.scrapeConnCh = nil, nil
+	if c.greeted {
+		c.greeted = false
+		c.attached = make(chan struct{})
+	}
+	if c.grace > 0 {
+		c.expiry = time.AfterFunc(c.grace, c.stop)
+	}
+	c.mu.Unlock()
+
+	closeScrapeConns(ch)
+	if c.grace <= 0 {
+		c.stop()
+	}
+}
+
+func closeScrapeConns(ch chan net.Conn) {
+	if ch == nil {
+		return
+	}
+	close(ch)
+	for conn := range ch {
+		conn.Close()
+	}
+}
+
+// Target is a process registered by a client.
+type Target struct {
+	Fqdn    string
+	Process string
+	// Labels are registered by the client for the process
+	Labels map[string]string
+	// Client describes the connection of the client, zero for restored targets
+	Client clientInfo
+	// LastRenewal is when the process was registered or its lease was last renewed
+	LastRenewal time.Time
+	// Stale is set once the lease of the registration lapsed
+	Stale bool
+	// Restored is set for stale targets restored from the persisted state, they are
+	// listed until the client registers them again or the restore period ends
+	Restored bool
+}
+
+// Address returns the address Prometheus scrapes the target with, <process_name>.<fqdn>:80
+func (t *Target) Address() string {
+	return fmt.Sprintf("%s.%s:80", t.Process, t.Fqdn)
+}
+
+// addScrapeTarget registers process with labels or renews its lease.
+func (c *Coordinator) addScrapeTarget(process string, labels map[string]string) {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	l, ok := c.known[process]
+	if !ok {
+		c.known[process] = &lease{labels: labels, renewed: time.Now()}
+		c.mu.Unlock()
+		c.reg.targetsChanged(1)
+		return
+	}
+	l.renewed = time.Now()
+	changed := l.stale || !equalLabels(l.labels, labels)
+	l.labels = labels
+	l.stale, l.restored = false, false
+	c.mu.Unlock()
+
+	if changed {
+		c.reg.targetsChanged(0)
+	}
+}
+
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Coordinator) delScrapeTarget(process string) {
+	c.mu.Lock()
+	_, ok := c.known[process]
+	delete(c.known, process)
+	targetStats.forget(c.fqdn, process)
+	c.mu.Unlock()
+
+	if ok {
+		c.reg.targetsChanged(-1)
+	}
+}
+
+// dropStaleTargets marks targets whose lease lapsed as stale and forgets those
+// that are stale longer than retention.
+func (c *Coordinator) dropStaleTargets(now time.Time, retention time.Duration) {
+	c.mu.Lock()
+	if c.leaseTTL <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	var changed bool
+	var dropped int
+	for process, l := range c.known {
+		age := now.Sub(l.renewed)
+		if age > c.leaseTTL+retention {
+			level.Debug(c.lg).Log("msg", "drop stale target", "fqdn", c.fqdn, "process", process)
+			delete(c.known, process)
+			targetStats.forget(c.fqdn, process)
+			dropped++
+		} else if age > c.leaseTTL && !l.stale {
+			l.stale = true
+			changed = true
+		}
+	}
+	c.mu.Unlock()
+
+	if changed || dropped > 0 {
+		c.reg.targetsChanged(-dropped)
+	}
+}
+
+// KnownTargets returns a list of registered targets, including the stale ones
+func (c *Coordinator) KnownTargets() []*Target {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	known := make([]string, 0, len(c.known))
-	for k := range c.known {
-		known = append(known, k)
+	now := time.Now()
+	known := make([]*Target, 0, len(c.known))
+	for process, l := range c.known {
+		known = append(known, &Target{
+			Fqdn:        c.fqdn,
+			Process:     process,
+			Labels:      l.labels,
+			Client:      c.client,
+			LastRenewal: l.renewed,
+			Stale:       l.stale || c.leaseTTL > 0 && now.Sub(l.renewed) > c.leaseTTL,
+			Restored:    l.restored,
+		})
 	}
 	return known
 }
 
+// writeCtl sends a message on the control connection conn.
+func (c *Coordinator) writeCtl(conn net.Conn, typ util.MsgType, msg []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return util.WriteMsg(conn, typ, msg)
+}
+
+// getScrapeConn returns a scrape connection to the client, waiting up to timeout
+// for a detached client to reconnect.
 func (c *Coordinator) getScrapeConn(timeout time.Duration) (net.Conn, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var ctlConn net.Conn
+	var scrapeConnCh chan net.Conn
+	for {
+		c.mu.Lock()
+		attached, greeted := c.attached, c.greeted
+		ctlConn, scrapeConnCh = c.ctlConn, c.scrapeConnCh
+		c.mu.Unlock()
+		if greeted {
+			break
+		}
+		level.Debug(c.lg).Log("msg", "wait for client to reconnect", "fqdn", c.fqdn)
+		select {
+		case <-attached:
+		case <-c.done:
+			return nil, fmt.Errorf("err coordinator stopped")
+		case <-timer.C:
+			return nil, fmt.Errorf("err timeout waiting for client to reconnect")
+		}
+	}
+
 	select {
-	case conn, ok := <-c.scrapeConnCh:
+	case conn, ok := <-scrapeConnCh:
 		if ok {
 			return conn, nil
 		}
 		return nil, fmt.Errorf("err scrapeConn channel closed")
 	default:
 		level.Debug(c.lg).Log("msg", "send "+util.MsgTypeReqScrapeConn+" to proxyc for new connection")
-		err := util.WriteMsg(c.ctlConn, util.MsgTypeReqScrapeConn, []byte{})
+		err := c.writeCtl(ctlConn, util.MsgTypeReqScrapeConn, []byte{})
 		if err != nil {
 			return nil, fmt.Errorf("err control connection closed")
 		}
 	}
 
 	select {
-	case conn := <-c.scrapeConnCh:
-		return conn, nil
-	case <-time.After(timeout):
+	case conn, ok := <-scrapeConnCh:
+		if ok {
+			return conn, nil
+		}
+		return nil, fmt.Errorf("err scrapeConn channel closed")
+	case <-timer.C:
 		return nil, fmt.Errorf("err timeout getScrapeConn")
 	}
 }
 
 func (c *Coordinator) registerScrapeConn(conn net.Conn) {
-	defer func() {
-		if err := recover(); err != nil {
-			level.Error(c.lg).Log("panic error", err)
-		}
-	}()
-	c.scrapeConnCh <- conn
+	// sending under c.mu keeps detach from closing the channel meanwhile
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scrapeConnCh == nil {
+		conn.Close()
+		return
+	}
+	select {
+	case c.scrapeConnCh <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// scrapeTimeout returns the scrape timeout registered for the process of host, <process_name>.<fqdn>[:port].
+func (c *Coordinator) scrapeTimeout(host string) time.Duration {
+	process := processOf(host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.known[process]
+	if !ok {
+		return 0
+	}
+	timeout, err := model.ParseDuration(l.labels[scrapeTimeoutLabel])
+	if err != nil {
+		return 0
+	}
+	return time.Duration(timeout)
 }
 
 func (c *Coordinator) handleScrape(w http.ResponseWriter, r *http.Request) {
@@ -91,30 +453,57 @@ func (c *Coordinator) handleScrape(w http.ResponseWriter, r *http.Request) {
 		r.Header = map[string][]string{}
 	}
 	util.EnsureHeaderTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header)
-	timeout, _ := util.GetHeaderTimeout(r.Header)
+	timeout := util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header)
+	if limit := c.scrapeTimeout(r.Host); limit > 0 && limit < timeout {
+		timeout = limit
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	if err := c.acquireScrape(r.Context(), deadline); err != nil {
+		level.Debug(c.lg).Log("msg", "scrape not admitted", "fqdn", c.fqdn, "err", err)
+		code, _ := strconv.Atoi(*limitRejectStatus)
+		w.WriteHeader(code)
+		c.recordScrape(r.Host, start, 0, stageQueue, err)
+		return
+	}
+	defer c.releaseScrape()
+	// the client gets the time left after waiting in the queue
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	defer cancel()
+	r = r.WithContext(ctx)
+	timeout = time.Until(deadline)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(timeout.Truncate(time.Millisecond).Seconds(), 'f', -1, 64))
+
 	rwc, err := c.getScrapeConn(timeout)
 	if err != nil {
+		level.Debug(c.lg).Log("msg", "failed to get scrape connection", "fqdn", c.fqdn, "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		c.recordScrape(r.Host, start, 0, stageTunnel, err)
 		return
 	}
 
-	defer func() {
-		go func() {
-			if len(c.scrapeConnCh) == cap(c.scrapeConnCh) {
-				rwc.Close()
-			} else {
-				c.registerScrapeConn(rwc)
-			}
-		}()
+	// Prometheus giving up on the scrape closes the scrape connection, which aborts the scrape on the client
+	stop, canceled := make(chan struct{}), make(chan bool, 1)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			rwc.Close()
+			canceled <- true
+		case <-stop:
+			canceled <- false
+		}
 	}()
 
 	var wg sync.WaitGroup
+	var writeErr, readErr error
+	var readStage string
+	var size int64
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		err := r.Write(rwc)
-		if err != nil {
-			level.Error(c.lg).Log("msg", "failed to write connection", "err", err)
+		writeErr = r.Write(rwc)
+		if writeErr != nil {
+			level.Error(c.lg).Log("msg", "failed to write connection", "err", writeErr)
 			rwc.Close()
 		}
 	}()
@@ -122,55 +511,133 @@ func (c *Coordinator) handleScrape(w http.ResponseWriter, r *http.Request) {
 		defer wg.Done()
 		resp, err := http.ReadResponse(bufio.NewReader(rwc), nil)
 		if err != nil {
+			readStage, readErr = stageResponse, err
 			rwc.Close()
 			return
 		}
-		for k, v := range resp.Header {
-			w.Header()[k] = v
+		size, err = c.writeResponse(w, r, resp)
+		if err != nil {
+			readStage, readErr = stageResponse, err
+		} else if resp.StatusCode != http.StatusOK {
+			readStage, readErr = stageStatus, fmt.Errorf("server returned HTTP status %s", resp.Status)
 		}
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
 	}()
 	wg.Wait()
+	close(stop)
+	if <-canceled {
+		writeErr, readErr = nil, r.Context().Err()
+		readStage = stageResponse
+	}
+	// only a connection the scrape was completed on is clean for the next one
+	if writeErr != nil || readErr != nil && readStage != stageStatus {
+		rwc.Close()
+	} else {
+		go c.registerScrapeConn(rwc)
+	}
+	if writeErr != nil {
+		c.recordScrape(r.Host, start, size, stageRequest, writeErr)
+	} else {
+		c.recordScrape(r.Host, start, size, readStage, readErr)
+	}
+}
+
+// acquireScrape takes a slot of the client and then of the global limiter, waiting up to deadline.
+func (c *Coordinator) acquireScrape(ctx context.Context, deadline time.Time) error {
+	if err := c.limiter.acquire(ctx, deadline); err != nil {
+		return err
+	}
+	if err := globalLimiter.acquire(ctx, deadline); err != nil {
+		c.limiter.release()
+		return err
+	}
+	return nil
 }
 
-func (c *Coordinator) start() {
+func (c *Coordinator) releaseScrape() {
+	globalLimiter.release()
+	c.limiter.release()
+}
+
+// processOf returns the process of host, <process_name>.<fqdn>[:port].
+func processOf(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.SplitN(host, ".", 2)[0]
+}
+
+// recordScrape accounts a scrape of host, <process_name>.<fqdn>[:port], if its process is registered.
+func (c *Coordinator) recordScrape(host string, start time.Time, size int64, stage string, err error) {
+	process := processOf(host)
+	c.mu.Lock()
+	_, ok := c.known[process]
+	c.mu.Unlock()
+	if ok {
+		targetStats.record(c.fqdn, process, time.Since(start), size, stage, err)
+	}
+}
+
+func (c *Coordinator) start(conn net.Conn) {
 	for {
-		msgType, msg, err := util.ReadMsg(c.ctlConn)
+		msgType, msg, err := util.ReadMsg(conn)
 		if err != nil {
 			if err == io.EOF {
 				level.Debug(c.lg).Log("msg", "control connection closed")
-				c.stop()
-				return
+			} else {
+				level.Debug(c.lg).Log("err read message", err)
 			}
-			level.Debug(c.lg).Log("err read message", err)
-			c.stop()
+			c.detach(conn)
 			return
 		}
 
-		conn := c.ctlConn
 		switch msgType {
-		case util.MsgTypeRegister:
-			process := string(msg)
-			c.addScrapeTarget(fmt.Sprintf("%s.%s:80", process, c.fqdn))
+		case util.MsgTypeRegister, util.MsgTypeRenew:
+			reg, err := util.UnmarshalIntoRegisterMessage(msg)
+			if err != nil {
+				level.Warn(c.lg).Log("msg", "broken "+msgType, "fqdn", c.fqdn, "err", err)
+				continue
+			}
+			if reg.Process == fanoutProcess {
+				level.Warn(c.lg).Log("msg", "refused to register reserved process name", "fqdn", c.fqdn, "process", reg.Process)
+				continue
+			}
+			c.addScrapeTarget(reg.Process, reg.Labels)
 		case util.MsgTypeDeregister:
-			process := string(msg)
-			c.delScrapeTarget(fmt.Sprintf("%s.%s:80", process, c.fqdn))
+			c.delScrapeTarget(string(msg))
 		default:
 			level.Warn(c.lg).Log("msg", "Error message type from conn"+conn.RemoteAddr().String())
-			conn.Close()
+			c.detach(conn)
+			return
 		}
 	}
 }
 
 func (c *Coordinator) stop() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	if c.stopped {
+		c.mu.Unlock()
 		return
 	}
-	c.known = nil
-	close(c.scrapeConnCh)
-	c.ctlConn.Close()
 	c.stopped = true
+	dropped := len(c.known)
+	c.known = nil
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	conn, ch, greeted := c.ctlConn, c.scrapeConnCh, c.greeted
+	c.ctlConn, c.scrapeConnCh, c.greeted = nil, nil, false
+	close(c.done)
+	c.mu.Unlock()
+
+	if conn != nil && greeted {
+		conn.Close()
+	}
+	closeScrapeConns(ch)
+	// the statistics by fqdn are kept for a coordinator that replaced c
+	c.reg.remove(c, func() {
+		targetStats.forget(c.fqdn, "")
+		tunnelCompression.forget(c.fqdn)
+	})
+	c.reg.targetsChanged(-dropped)
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeases(t *testing.T) {
+	c := newCoordinator(log.NewLogfmtLogger(os.Stdout), "client", "", newTicket(), 0, newRegistry())
+	c.leaseTTL = time.Minute
+	c.addScrapeTarget("fresh", nil)
+	c.addScrapeTarget("lapsed", nil)
+	c.addScrapeTarget("gone", nil)
+	now := time.Now()
+	c.known["lapsed"].renewed = now.Add(-2 * time.Minute)
+	c.known["gone"].renewed = now.Add(-2 * time.Hour)
+
+	c.dropStaleTargets(now, time.Hour)
+	stale := map[string]bool{}
+	for _, tg := range c.KnownTargets() {
+		stale[tg.Process] = tg.Stale
+	}
+	assert.Equal(t, map[string]bool{"fresh": false, "lapsed": true}, stale)
+
+	// a renewal revives a stale target
+	c.addScrapeTarget("lapsed", nil)
+	for _, tg := range c.KnownTargets() {
+		assert.False(t, tg.Stale, tg.Process)
+	}
+}
+
+func TestRegisteredScrapeSettings(t *testing.T) {
+	reg := newRegistry()
+	c := newCoordinator(log.NewNopLogger(), "client", "", newTicket(), time.Minute, reg)
+	reg.update("client", func(*Coordinator) *Coordinator { return c })
+	c.addScrapeTarget("jmx", map[string]string{"job": "jmx", "__scrape_interval__": "2m", "__scrape_timeout__": "100ms", "__metrics_path__": "/jmx", "team": "infra"})
+	c.addScrapeTarget("node", nil)
+
+	tgs := targetGroups(reg.Targets(), nil, false, time.Now())
+	if assert.Len(t, tgs, 2) {
+		assert.Equal(t, "jmx", tgs[0].Labels["job"])
+		assert.Equal(t, "2m", tgs[0].Labels["__scrape_interval__"])
+		assert.Equal(t, "100ms", tgs[0].Labels["__scrape_timeout__"])
+		assert.Equal(t, "infra", tgs[0].Labels["__meta_pushprox_label_team"])
+		assert.NotContains(t, tgs[0].Labels, "__meta_pushprox_label___scrape_timeout__")
+		assert.Equal(t, "/jmx", tgs[0].Labels["__meta_pushprox_metrics_path"])
+		assert.NotContains(t, tgs[0].Labels, "__metrics_path__")
+		assert.NotContains(t, tgs[1].Labels, "job")
+	}
+
+	assert.Equal(t, 100*time.Millisecond, c.scrapeTimeout("jmx.client:80"))
+	assert.Equal(t, time.Duration(0), c.scrapeTimeout("node.client:80"))
+
+	// the scrape gives up waiting for the detached client after the registered timeout
+	r := httptest.NewRequest("GET", "http://jmx.client:80/metrics", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "60")
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	c.handleScrape(rec, r)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	timeout, _ := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	assert.True(t, timeout > 0.05 && timeout <= 0.1, timeout)
+}
+
+func TestScrapeTimeoutQueued(t *testing.T) {
+	c := newCoordinator(log.NewNopLogger(), "client", "", newTicket(), time.Minute, newRegistry())
+	c.limiter = newScrapeLimiter("queued", 1, 1)
+	assert.NoError(t, c.acquireScrape(context.Background(), time.Now().Add(time.Second)))
+
+	// the time waited for a slot is taken off the timeout passed on
+	r := httptest.NewRequest("GET", "http://node.client:80/metrics", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.5")
+	done := make(chan struct{})
+	go func() {
+		c.handleScrape(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	c.releaseScrape()
+	<-done
+	timeout, _ := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	assert.True(t, timeout > 0.1 && timeout <= 0.3, timeout)
+}
+
+func TestGreet(t *testing.T) {
+	c := newCoordinator(log.NewNopLogger(), "client", "", newTicket(), time.Minute, newRegistry())
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	ticket, ok := c.attach(conn, 0, clientInfo{})
+	assert.True(t, ok)
+	assert.Equal(t, c.ticket, ticket)
+
+	// scrapes wait for the client to be greeted
+	go c.getScrapeConn(time.Second)
+	time.Sleep(20 * time.Millisecond)
+	go c.greet(conn, util.MsgTypeNewMachineOK, []byte(ticket))
+	typ, msg, err := util.ReadMsg(peer)
+	assert.NoError(t, err)
+	assert.Equal(t, util.MsgTypeNewMachineOK, typ)
+	assert.Equal(t, ticket, string(msg))
+	typ, _, err = util.ReadMsg(peer)
+	assert.NoError(t, err)
+	assert.Equal(t, util.MsgTypeReqScrapeConn, typ)
+
+	// a replaced connection is closed once greeted
+	replaced, replacedPeer := net.Pipe()
+	_, ok = c.attach(replaced, 0, clientInfo{})
+	assert.True(t, ok)
+	newer, newerPeer := net.Pipe()
+	defer newerPeer.Close()
+	_, ok = c.attach(newer, 0, clientInfo{})
+	assert.True(t, ok)
+	go c.greet(replaced, util.MsgTypeNewMachineOK, nil)
+	_, _, err = util.ReadMsg(replacedPeer)
+	assert.NoError(t, err)
+	_, _, err = util.ReadMsg(replacedPeer)
+	assert.Error(t, err)
+}
+
+func TestStopReplaced(t *testing.T) {
+	reg := newRegistry()
+	old := newCoordinator(log.NewNopLogger(), "replaced.example", "", newTicket(), 0, reg)
+	reg.update(old.fqdn, func(*Coordinator) *Coordinator { return old })
+
+	// the client reconnects without resuming, the old coordinator stops after the new one scraped
+	c := newCoordinator(log.NewNopLogger(), "replaced.example", "", newTicket(), 0, reg)
+	reg.update(c.fqdn, func(*Coordinator) *Coordinator { return c })
+	targetStats.record(c.fqdn, "node", time.Millisecond, 10, "", nil)
+	tunnelCompression.record(c.fqdn, 10, 20)
+	old.stop()
+
+	scraped := func() (stats, compression bool) {
+		for _, st := range targetStats.snapshot() {
+			stats = stats || st.Fqdn == c.fqdn
+		}
+		tunnelCompression.mu.Lock()
+		_, compression = tunnelCompression.clients[c.fqdn]
+		tunnelCompression.mu.Unlock()
+		return
+	}
+	stats, compression := scraped()
+	assert.True(t, stats)
+	assert.True(t, compression)
+	assert.True(t, c == reg.get(c.fqdn))
+
+	c.stop()
+	stats, compression = scraped()
+	assert.False(t, stats)
+	assert.False(t, compression)
+}
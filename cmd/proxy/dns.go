@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsMaxUDPSize = 512
+	// dnsService is the service of the SRV records listing all targets
+	dnsService = "_pushprox._tcp."
+)
+
+// dnsServer is an authoritative DNS server for dns_sd_configs. In zone it answers
+//
+//	_pushprox._tcp.<zone>         SRV of all targets
+//	_pushprox._tcp.<fqdn>.<zone>  SRV of the targets of a client
+//	_<process>._tcp.<zone>        SRV of the targets of a process on all clients
+//	<process>.<fqdn>.<zone>       A of the proxy, the target of the SRV records
+//
+// The SRV records point at port 80 of <process>.<fqdn>.<zone>, which the proxy scrapes
+// like <process>.<fqdn>. They are built from the registry whenever it changed.
+type dnsServer struct {
+	lg   log.Logger
+	reg  *registry
+	zone dnsmessage.Name // fully qualified, lower case
+	ip   net.IP          // of the proxy, A records are answered if set
+	ttl  uint32
+
+	mu      sync.Mutex
+	version uint64
+	records *dnsRecords
+}
+
+type dnsRecords struct {
+	srv   map[string][]dnsmessage.Name // by lower case name
+	hosts map[string]bool
+}
+
+func newDNSServer(lg log.Logger, reg *registry, zone string, ip net.IP, ttl uint32) (*dnsServer, error) {
+	name, err := dnsmessage.NewName(dnsFqdn(zone))
+	if err != nil {
+		return nil, err
+	}
+	return &dnsServer{lg: lg, reg: reg, zone: name, ip: ip.To4(), ttl: ttl}, nil
+}
+
+func dnsFqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// serveDNS serves the DNS records of the targets on addr over UDP and TCP.
+func (s *server) serveDNS(addr, zone, ip string, ttl time.Duration) error {
+	var advertised net.IP
+	if ip != "" {
+		if advertised = net.ParseIP(ip).To4(); advertised == nil {
+			return fmt.Errorf("invalid IPv4 address %q", ip)
+		}
+	}
+	d, err := newDNSServer(s.lg, s.reg, zone, advertised, uint32(ttl.Seconds()))
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	level.Info(s.lg).Log("msg", "serving DNS", "addr", addr, "zone", d.zone)
+	go d.ServeUDP(pc)
+	go d.ServeTCP(l)
+	return nil
+}
+
+// snapshot returns the records of the current registry version.
+func (d *dnsServer) snapshot() *dnsRecords {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	version := d.reg.Version()
+	if d.records != nil && d.version == version {
+		return d.records
+	}
+	zone := d.zone.String()
+	rs := &dnsRecords{srv: map[string][]dnsmessage.Name{}, hosts: map[string]bool{}}
+	for _, t := range listedTargets(d.reg.Targets(), false) {
+		target, err := dnsmessage.NewName(t.Process + "." + t.Fqdn + "." + zone)
+		if err != nil {
+			continue
+		}
+		for _, name := range []string{
+			dnsService + zone,
+			dnsService + dnsFqdn(t.Fqdn) + zone,
+			"_" + dnsFqdn(t.Process) + "_tcp." + zone,
+		} {
+			rs.srv[name] = append(rs.srv[name], target)
+		}
+		rs.hosts[strings.ToLower(target.String())] = true
+	}
+	d.version, d.records = version, rs
+	return rs
+}
+
+// ServeUDP answers the queries arriving on conn until it is closed.
+func (d *dnsServer) ServeUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			level.Warn(d.lg).Log("msg", "DNS listener closed", "err", err)
+			return
+		}
+		resp, err := d.answer(buf[:n], true)
+		if err != nil {
+			level.Debug(d.lg).Log("msg", "bad DNS query", "from", addr, "err", err)
+			continue
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+// ServeTCP answers the queries of the connections accepted on l until it is closed.
+func (d *dnsServer) ServeTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			level.Warn(d.lg).Log("msg", "DNS listener closed", "err", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var length uint16
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+					return
+				}
+				req := make([]byte, length)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				resp, err := d.answer(req, false)
+				if err != nil {
+					level.Debug(d.lg).Log("msg", "bad DNS query", "from", conn.RemoteAddr(), "err", err)
+					return
+				}
+				b := make([]byte, 2, 2+len(resp))
+				binary.BigEndian.PutUint16(b, uint16(len(resp)))
+				if _, err := conn.Write(append(b, resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer returns the response to the query req. UDP responses that don't fit
+// the size the client accepts are truncated.
+func (d *dnsServer) answer(req []byte, udp bool) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil && err != dnsmessage.ErrSectionDone {
+		return nil, err
+	}
+	maxSize := dnsMaxUDPSize
+	if err == nil && udp {
+		p.SkipAllQuestions()
+		p.SkipAllAnswers()
+		p.SkipAllAuthorities()
+		for {
+			rh, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type == dnsmessage.TypeOPT && int(rh.Class) > maxSize {
+				maxSize = int(rh.Class)
+			}
+			p.SkipAdditional()
+		}
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: h.ID, Response: true, OpCode: h.OpCode, Authoritative: true, RecursionDesired: h.RecursionDesired},
+	}
+	if h.OpCode != 0 {
+		msg.RCode = dnsmessage.RCodeNotImplemented
+		return msg.Pack()
+	}
+	if err == dnsmessage.ErrSectionDone {
+		msg.RCode = dnsmessage.RCodeFormatError
+		return msg.Pack()
+	}
+	msg.Questions = []dnsmessage.Question{q}
+	d.resolve(&msg, q)
+
+	resp, err := msg.Pack()
+	if err != nil || !udp || len(resp) <= maxSize {
+		return resp, err
+	}
+	msg.Truncated = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, nil
+	return msg.Pack()
+}
+
+func (d *dnsServer) resolve(msg *dnsmessage.Message, q dnsmessage.Question) {
+	name := strings.ToLower(q.Name.String())
+	zone := d.zone.String()
+	if name != zone && !strings.HasSuffix(name, "."+zone) {
+		msg.Authoritative = false
+		msg.RCode = dnsmessage.RCodeRefused
+		return
+	}
+	rs := d.snapshot()
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: d.ttl}
+	srv, isSRV := rs.srv[name]
+	isHost := rs.hosts[name]
+
+	switch {
+	case isSRV && (q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeALL):
+		for _, target := range srv {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: hdr,
+				Body:   &dnsmessage.SRVResource{Priority: 0, Weight: 0, Port: 80, Target: target},
+			})
+			if d.ip != nil {
+				msg.Additionals = append(msg.Additionals, d.a(target))
+			}
+		}
+	case isHost && d.ip != nil && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL):
+		msg.Answers = append(msg.Answers, d.a(q.Name))
+	case name == zone && q.Type == dnsmessage.TypeSOA:
+		msg.Answers = append(msg.Answers, d.soa())
+	case name == zone || isSRV || isHost:
+		// the name exists without records of the type
+		msg.Authorities = append(msg.Authorities, d.soa())
+	default:
+		msg.RCode = dnsmessage.RCodeNameError
+		msg.Authorities = append(msg.Authorities, d.soa())
+	}
+}
+
+func (d *dnsServer) a(name dnsmessage.Name) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], d.ip)
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: d.ttl},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func (d *dnsServer) soa() dnsmessage.Resource {
+	zone := d.zone.String()
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: d.zone, Class: dnsmessage.ClassINET, TTL: d.ttl},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns." + zone),
+			MBox:    dnsmessage.MustNewName("hostmaster." + zone),
+			Serial:  uint32(d.reg.Version()),
+			Refresh: d.ttl,
+			Retry:   d.ttl,
+			Expire:  d.ttl * 10,
+			MinTTL:  d.ttl,
+		},
+	}
+}
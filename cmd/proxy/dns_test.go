@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSServer(t *testing.T) {
+	reg := newRegistry()
+	for _, fqdn := range []string{"edge-1", "edge-2"} {
+		c := newCoordinator(log.NewNopLogger(), fqdn, "", newTicket(), 0, reg)
+		reg.update(fqdn, func(*Coordinator) *Coordinator { return c })
+		c.addScrapeTarget("node", nil)
+		if fqdn == "edge-1" {
+			c.addScrapeTarget("app", nil)
+		}
+	}
+	d, err := newDNSServer(log.NewNopLogger(), reg, "PushProx.example", net.ParseIP("10.0.0.1"), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go d.ServeUDP(pc)
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", pc.LocalAddr().String())
+		},
+	}
+	lookupSRV := func(name string) []string {
+		_, srvs, err := resolver.LookupSRV(context.Background(), "", "", name)
+		assert.NoError(t, err, name)
+		var targets []string
+		for _, srv := range srvs {
+			assert.Equal(t, uint16(80), srv.Port)
+			targets = append(targets, srv.Target)
+		}
+		sort.Strings(targets)
+		return targets
+	}
+
+	assert.Equal(t, []string{
+		"app.edge-1.pushprox.example.",
+		"node.edge-1.pushprox.example.",
+		"node.edge-2.pushprox.example.",
+	}, lookupSRV("_pushprox._tcp.pushprox.example."))
+	assert.Equal(t, []string{"node.edge-1.pushprox.example.", "node.edge-2.pushprox.example."}, lookupSRV("_node._tcp.pushprox.example."))
+	assert.Equal(t, []string{"app.edge-1.pushprox.example.", "node.edge-1.pushprox.example."}, lookupSRV("_pushprox._tcp.edge-1.pushprox.example."))
+
+	addrs, err := resolver.LookupHost(context.Background(), "node.edge-2.pushprox.example.")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, addrs)
+
+	// records follow the registry
+	reg.get("edge-2").delScrapeTarget("node")
+	assert.Equal(t, []string{"node.edge-1.pushprox.example."}, lookupSRV("_node._tcp.pushprox.example."))
+	_, err = resolver.LookupHost(context.Background(), "node.edge-2.pushprox.example.")
+	assert.Error(t, err)
+
+	query := func(name string, typ dnsmessage.Type) dnsmessage.Message {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET})
+		req, _ := b.Finish()
+		resp, err := d.answer(req, true)
+		assert.NoError(t, err)
+		var msg dnsmessage.Message
+		assert.NoError(t, msg.Unpack(resp))
+		return msg
+	}
+	msg := query("unknown.pushprox.example.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+	assert.True(t, msg.Authoritative)
+	assert.Len(t, msg.Authorities, 1)
+	msg = query("example.org.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeRefused, msg.RCode)
+	msg = query("pushprox.example.", dnsmessage.TypeSOA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	assert.Len(t, msg.Answers, 1)
+}
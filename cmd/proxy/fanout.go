@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// fanoutProcess is the reserved process name scraping all processes of a client at once, all.<fqdn>
+	fanoutProcess = "all"
+	// processLabel is added to the series of a fan-out scrape, naming the process they were scraped from
+	processLabel = "pushprox_process"
+)
+
+// processScrape is the result of scraping a process in a fan-out scrape.
+type processScrape struct {
+	process  string
+	families []*dto.MetricFamily
+	duration time.Duration
+	err      error
+}
+
+// handleFanout scrapes all registered processes concurrently and merges them into one exposition,
+// a failing process is reported by pushprox_process_scrape_success rather than failing the scrape.
+func (c *Coordinator) handleFanout(w http.ResponseWriter, r *http.Request) {
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var processes []string
+	for _, t := range c.KnownTargets() {
+		if !t.Stale {
+			processes = append(processes, t.Process)
+		}
+	}
+	sort.Strings(processes)
+
+	scrapes := make([]*processScrape, len(processes))
+	var wg sync.WaitGroup
+	for i, process := range processes {
+		wg.Add(1)
+		go func(i int, process string) {
+			defer wg.Done()
+			req := r.Clone(r.Context())
+			req.Host = net.JoinHostPort(process+"."+c.fqdn, port)
+			req.URL.Host = req.Host
+			// the merged exposition is text, compressed or not by the proxy listener
+			req.Header.Del("Accept-Encoding")
+			req.Header.Set("Accept", string(expfmt.FmtText))
+			scrapes[i] = c.scrapeProcess(req, process)
+		}(i, process)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	for _, mf := range mergeScrapes(scrapes) {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			level.Debug(c.lg).Log("msg", "failed to write fan-out scrape", "fqdn", c.fqdn, "err", err)
+			return
+		}
+	}
+}
+
+func (c *Coordinator) scrapeProcess(r *http.Request, process string) *processScrape {
+	start := time.Now()
+	rec := &bufferedResponse{header: http.Header{}, code: http.StatusOK}
+	c.handleScrape(rec, r)
+	s := &processScrape{process: process, duration: time.Since(start)}
+	if rec.code != http.StatusOK {
+		s.err = fmt.Errorf("server returned HTTP status %d", rec.code)
+	} else {
+		s.families, s.err = decodeScrape(rec)
+	}
+	if s.err != nil {
+		level.Debug(c.lg).Log("msg", "failed to scrape process", "fqdn", c.fqdn, "process", process, "err", s.err)
+	}
+	return s
+}
+
+func decodeScrape(rec *bufferedResponse) ([]*dto.MetricFamily, error) {
+	var body io.Reader = &rec.body
+	if rec.header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		body = gr
+	}
+	dec := expfmt.NewDecoder(body, expfmt.ResponseFormat(rec.header))
+	var families []*dto.MetricFamily
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+}
+
+// mergeScrapes labels the series of each process with processLabel and merges families of the same name,
+// a family clashing with the type of an earlier one is dropped. The families are sorted by name and
+// followed by the success and duration of the process scrapes.
+func mergeScrapes(scrapes []*processScrape) []*dto.MetricFamily {
+	merged := map[string]*dto.MetricFamily{}
+	success := &dto.MetricFamily{
+		Name: strp("pushprox_process_scrape_success"),
+		Help: strp("Whether the scrape of the process in a fan-out scrape succeeded."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	duration := &dto.MetricFamily{
+		Name: strp("pushprox_process_scrape_duration_seconds"),
+		Help: strp("Duration of the scrape of the process in a fan-out scrape."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, s := range scrapes {
+		up := 0.0
+		if s.err == nil {
+			up = 1
+		}
+		success.Metric = append(success.Metric, processGauge(s.process, up))
+		duration.Metric = append(duration.Metric, processGauge(s.process, s.duration.Seconds()))
+
+		for _, mf := range s.families {
+			for _, m := range mf.Metric {
+				m.Label = withProcessLabel(m.Label, s.process)
+			}
+			prev, ok := merged[mf.GetName()]
+			if !ok {
+				merged[mf.GetName()] = mf
+			} else if prev.GetType() == mf.GetType() {
+				prev.Metric = append(prev.Metric, mf.Metric...)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*dto.MetricFamily, 0, len(names)+2)
+	for _, name := range names {
+		families = append(families, merged[name])
+	}
+	return append(families, success, duration)
+}
+
+// withProcessLabel sets processLabel on labels, replacing one exposed by the process itself.
+func withProcessLabel(labels []*dto.LabelPair, process string) []*dto.LabelPair {
+	for _, l := range labels {
+		if l.GetName() == processLabel {
+			l.Value = strp(process)
+			return labels
+		}
+	}
+	return append(labels, &dto.LabelPair{Name: strp(processLabel), Value: strp(process)})
+}
+
+func processGauge(process string, v float64) *dto.Metric {
+	return &dto.Metric{
+		Label: []*dto.LabelPair{{Name: strp(processLabel), Value: strp(process)}},
+		Gauge: &dto.Gauge{Value: &v},
+	}
+}
+
+func strp(s string) *string {
+	return &s
+}
+
+// bufferedResponse is a http.ResponseWriter keeping the response in memory.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	b.code = code
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	fileSDWrites = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "file_sd_writes_total",
+			Help:      "Number of file_sd files written.",
+		})
+	fileSDWriteErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "file_sd_write_errors_total",
+			Help:      "Number of file_sd files that failed to be written.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(fileSDWrites, fileSDWriteErrors)
+}
+
+// fileSD writes the targets of the registry to a file for file_sd_configs, in YAML if
+// the file ends with .yml or .yaml and JSON otherwise. With splitLabel, the targets are
+// additionally split into one file per value of the label registered by the clients,
+// <name>_<value><ext> next to the file.
+type fileSD struct {
+	lg         log.Logger
+	reg        *registry
+	path       string
+	splitLabel string
+
+	split map[string]bool // split files of the last write
+}
+
+func newFileSD(lg log.Logger, reg *registry, path, splitLabel string) *fileSD {
+	return &fileSD{lg: lg, reg: reg, path: path, splitLabel: splitLabel, split: map[string]bool{}}
+}
+
+// run writes the files whenever the registry changes, at most once per interval.
+func (f *fileSD) run(interval time.Duration) {
+	for {
+		changed := f.reg.Changed()
+		f.write(time.Now())
+		<-changed
+		time.Sleep(interval)
+	}
+}
+
+func (f *fileSD) write(now time.Time) {
+	tgs := targetGroups(f.reg.Targets(), nil, false, now)
+	f.writeFile(f.path, tgs)
+	if f.splitLabel == "" {
+		return
+	}
+
+	byValue := map[string][]*targetGroup{}
+	name := metaLabelPrefix + "label_" + sanitizeLabelName(f.splitLabel)
+	for _, tg := range tgs {
+		if v := tg.Labels[name]; v != "" {
+			byValue[v] = append(byValue[v], tg)
+		}
+	}
+	ext := filepath.Ext(f.path)
+	split := make(map[string]bool, len(byValue))
+	for v, tgs := range byValue {
+		path := strings.TrimSuffix(f.path, ext) + "_" + sanitizeFileName(v) + ext
+		split[path] = true
+		f.writeFile(path, tgs)
+	}
+	for path := range f.split {
+		if !split[path] {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				level.Error(f.lg).Log("msg", "failed to remove file_sd file", "path", path, "err", err)
+			}
+		}
+	}
+	f.split = split
+}
+
+func (f *fileSD) writeFile(path string, tgs []*targetGroup) {
+	var b []byte
+	var err error
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		b, err = yaml.Marshal(tgs)
+	default:
+		b, err = json.MarshalIndent(tgs, "", "  ")
+	}
+	if err == nil {
+		err = util.WriteFileAtomic(path, b, 0644)
+	}
+	if err != nil {
+		fileSDWriteErrors.Inc()
+		level.Error(f.lg).Log("msg", "failed to write file_sd file", "path", path, "err", err)
+		return
+	}
+	fileSDWrites.Inc()
+}
+
+// sanitizeFileName replaces path separators and other characters unfit for file names with underscores.
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, s)
+}
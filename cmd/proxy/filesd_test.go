@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestFileSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := newRegistry()
+	c := newCoordinator(log.NewNopLogger(), "client", "", newTicket(), 0, reg)
+	reg.update("client", func(*Coordinator) *Coordinator { return c })
+	changed := reg.Changed()
+	c.addScrapeTarget("node", map[string]string{"tenant": "a"})
+	c.addScrapeTarget("app", map[string]string{"tenant": "b/c"})
+	c.addScrapeTarget("other", nil)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("registry change not notified")
+	}
+
+	readJSON := func(path string) []*targetGroup {
+		var tgs []*targetGroup
+		b, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(b, &tgs))
+		return tgs
+	}
+
+	f := newFileSD(log.NewNopLogger(), reg, filepath.Join(dir, "targets.json"), "tenant")
+	f.write(time.Now())
+	assert.Len(t, readJSON(filepath.Join(dir, "targets.json")), 3)
+	if tgs := readJSON(filepath.Join(dir, "targets_a.json")); assert.Len(t, tgs, 1) {
+		assert.Equal(t, []string{"node.client:80"}, tgs[0].Targets)
+	}
+	assert.Len(t, readJSON(filepath.Join(dir, "targets_b_c.json")), 1)
+
+	// split files of values gone are removed
+	c.delScrapeTarget("app")
+	f.write(time.Now())
+	_, err = os.Stat(filepath.Join(dir, "targets_b_c.json"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, readJSON(filepath.Join(dir, "targets.json")), 2)
+
+	f = newFileSD(log.NewNopLogger(), reg, filepath.Join(dir, "targets.yml"), "")
+	f.write(time.Now())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "targets.yml"))
+	assert.NoError(t, err)
+	var tgs []*targetGroup
+	assert.NoError(t, yaml.Unmarshal(b, &tgs))
+	assert.Len(t, tgs, 2)
+
+	f = newFileSD(log.NewNopLogger(), reg, filepath.Join(dir, "missing", "targets.json"), "")
+	before := testutil.ToFloat64(fileSDWriteErrors)
+	f.write(time.Now())
+	assert.Equal(t, before+1, testutil.ToFloat64(fileSDWriteErrors))
+}
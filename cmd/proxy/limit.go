@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scopes of the scrape limiters.
+const (
+	scopeClient = "client"
+	scopeGlobal = "global"
+)
+
+var (
+	errQueueFull    = errors.New("scrape queue is full")
+	errQueueTimeout = errors.New("scrape timed out in queue")
+
+	scrapesInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: namespace + "_scrapes_in_flight",
+			Help: "Scrapes holding a slot of a limiter, summed over the clients for the client scope.",
+		},
+		[]string{"scope"},
+	)
+	scrapeQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: namespace + "_scrape_queue_depth",
+			Help: "Scrapes waiting for a slot of a limiter, summed over the clients for the client scope.",
+		},
+		[]string{"scope"},
+	)
+	scrapeQueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: namespace + "_scrape_queue_wait_seconds",
+			Help: "Time scrapes waited for a slot of a limiter.",
+		},
+		[]string{"scope"},
+	)
+	scrapesRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: namespace + "_scrapes_rejected_total",
+			Help: "Scrapes rejected by a limiter, as its queue was full or the scrape timed out waiting.",
+		},
+		[]string{"scope", "reason"},
+	)
+
+	// globalLimiter limits the scrapes of all clients, nil if unlimited
+	globalLimiter *scrapeLimiter
+)
+
+func init() {
+	prometheus.MustRegister(scrapesInFlight, scrapeQueueDepth, scrapeQueueWait, scrapesRejected)
+}
+
+// scrapeLimiter admits a number of scrapes in flight, further scrapes wait in a bounded queue
+// until a slot frees up or their timeout expires. A nil limiter admits all scrapes.
+type scrapeLimiter struct {
+	queued   int64 // accessed atomically
+	maxQueue int64
+	scope    string
+	slots    chan struct{}
+}
+
+// newScrapeLimiter returns a limiter of inflight scrapes queueing up to queue more,
+// or nil if inflight isn't positive.
+func newScrapeLimiter(scope string, inflight, queue int) *scrapeLimiter {
+	if inflight <= 0 {
+		return nil
+	}
+	return &scrapeLimiter{scope: scope, slots: make(chan struct{}, inflight), maxQueue: int64(queue)}
+}
+
+// acquire takes a slot, waiting in the queue until deadline. A taken slot must be given back with release.
+func (l *scrapeLimiter) acquire(ctx context.Context, deadline time.Time) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		scrapesInFlight.WithLabelValues(l.scope).Inc()
+		scrapeQueueWait.WithLabelValues(l.scope).Observe(0)
+		return nil
+	default:
+	}
+
+	if atomic.AddInt64(&l.queued, 1) > l.maxQueue {
+		atomic.AddInt64(&l.queued, -1)
+		scrapesRejected.WithLabelValues(l.scope, "queue_full").Inc()
+		return errQueueFull
+	}
+	scrapeQueueDepth.WithLabelValues(l.scope).Inc()
+	defer func() {
+		atomic.AddInt64(&l.queued, -1)
+		scrapeQueueDepth.WithLabelValues(l.scope).Dec()
+	}()
+
+	start := time.Now()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		scrapesInFlight.WithLabelValues(l.scope).Inc()
+		scrapeQueueWait.WithLabelValues(l.scope).Observe(time.Since(start).Seconds())
+		return nil
+	case <-timer.C:
+		scrapesRejected.WithLabelValues(l.scope, "timeout").Inc()
+		return errQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *scrapeLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+	scrapesInFlight.WithLabelValues(l.scope).Dec()
+}
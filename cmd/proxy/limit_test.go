@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeLimiter(t *testing.T) {
+	var unlimited *scrapeLimiter
+	assert.NoError(t, unlimited.acquire(context.Background(), time.Now()))
+	unlimited.release()
+
+	l := newScrapeLimiter("test", 1, 1)
+	full := testutil.ToFloat64(scrapesRejected.WithLabelValues("test", "queue_full"))
+	timedOut := testutil.ToFloat64(scrapesRejected.WithLabelValues("test", "timeout"))
+	ctx := context.Background()
+	assert.NoError(t, l.acquire(ctx, time.Now().Add(time.Second)))
+
+	admitted := make(chan error)
+	go func() { admitted <- l.acquire(ctx, time.Now().Add(time.Second)) }()
+	for i := 0; i < 100 && testutil.ToFloat64(scrapeQueueDepth.WithLabelValues("test")) < 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, errQueueFull, l.acquire(ctx, time.Now().Add(time.Second)))
+
+	l.release()
+	assert.NoError(t, <-admitted)
+	assert.Equal(t, 0.0, testutil.ToFloat64(scrapeQueueDepth.WithLabelValues("test")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(scrapesInFlight.WithLabelValues("test")))
+
+	assert.Equal(t, errQueueTimeout, l.acquire(ctx, time.Now().Add(10*time.Millisecond)))
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, l.acquire(canceled, time.Now().Add(time.Second)))
+	assert.Equal(t, full+1, testutil.ToFloat64(scrapesRejected.WithLabelValues("test", "queue_full")))
+	assert.Equal(t, timedOut+1, testutil.ToFloat64(scrapesRejected.WithLabelValues("test", "timeout")))
+	l.release()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const registryShards = 64
+
+var (
+	knownTargetsDesc = prometheus.NewDesc(
+		namespace+"_targets",
+		"Number of known pushprox targets.",
+		nil, nil,
+	)
+	knownClientsDesc = prometheus.NewDesc(
+		namespace+"_clients",
+		"Number of known pushprox clients.",
+		nil, nil,
+	)
+)
+
+// registry holds the coordinators of the clients by fqdn. It is sharded so that
+// tens of thousands of clients connecting and registering don't contend on one lock,
+// readers take a snapshot shard by shard.
+type registry struct {
+	version uint64 // bumped on every change of clients or targets, accessed atomically
+	targets int64  // accessed atomically
+	clients int64  // accessed atomically
+
+	shards [registryShards]registryShard
+
+	mu      sync.Mutex
+	changed chan struct{} // closed on the next change
+}
+
+type registryShard struct {
+	mu      sync.RWMutex
+	remotes map[string]*Coordinator
+}
+
+func newRegistry() *registry {
+	r := &registry{changed: make(chan struct{})}
+	for i := range r.shards {
+		r.shards[i].remotes = map[string]*Coordinator{}
+	}
+	return r
+}
+
+func (r *registry) shard(fqdn string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(fqdn))
+	return &r.shards[h.Sum32()%registryShards]
+}
+
+// Version returns a number that changes whenever the clients or their targets change.
+func (r *registry) Version() uint64 {
+	return atomic.LoadUint64(&r.version)
+}
+
+// Changed returns a channel that is closed on the next change of the clients or targets.
+func (r *registry) Changed() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.changed
+}
+
+func (r *registry) bump() {
+	atomic.AddUint64(&r.version, 1)
+	r.mu.Lock()
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+}
+
+// targetsChanged records a change of the registered targets, delta is the change of their number.
+func (r *registry) targetsChanged(delta int) {
+	atomic.AddInt64(&r.targets, int64(delta))
+	r.bump()
+}
+
+// get returns the coordinator of fqdn, nil if there is none.
+func (r *registry) get(fqdn string) *Coordinator {
+	sh := r.shard(fqdn)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.remotes[fqdn]
+}
+
+// update replaces the coordinator of fqdn with the one returned by f, which is called
+// with the current coordinator or nil while holding the shard.
+func (r *registry) update(fqdn string, f func(old *Coordinator) *Coordinator) {
+	sh := r.shard(fqdn)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	old := sh.remotes[fqdn]
+	c := f(old)
+	if c == old {
+		return
+	}
+	sh.remotes[fqdn] = c
+	if old == nil {
+		atomic.AddInt64(&r.clients, 1)
+	}
+	r.bump()
+}
+
+// remove forgets c unless it was already replaced. forget is called then, before
+// another coordinator can be registered for the fqdn of c.
+func (r *registry) remove(c *Coordinator, forget func()) {
+	sh := r.shard(c.fqdn)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.remotes[c.fqdn] != c {
+		return
+	}
+	delete(sh.remotes, c.fqdn)
+	forget()
+	atomic.AddInt64(&r.clients, -1)
+	r.bump()
+}
+
+// coordinators returns a snapshot of all coordinators.
+func (r *registry) coordinators() []*Coordinator {
+	var cs []*Coordinator
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mu.RLock()
+		for _, c := range sh.remotes {
+			cs = append(cs, c)
+		}
+		sh.mu.RUnlock()
+	}
+	return cs
+}
+
+// Targets returns a snapshot of the targets of all clients, including the stale ones.
+func (r *registry) Targets() []*Target {
+	var targets []*Target
+	for _, c := range r.coordinators() {
+		targets = append(targets, c.KnownTargets()...)
+	}
+	return targets
+}
+
+// Describe implements prometheus.Collector.
+func (r *registry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- knownTargetsDesc
+	ch <- knownClientsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (r *registry) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(knownTargetsDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(&r.targets)))
+	ch <- prometheus.MustNewConstMetric(knownClientsDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(&r.clients)))
+}
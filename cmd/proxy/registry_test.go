@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRegistryChurn connects, resumes and replaces clients concurrently while
+// targets are listed and scraped, run it with -race.
+func TestRegistryChurn(t *testing.T) {
+	s, ha := newTestServer(t, 20*time.Millisecond)
+	defer s.l.Close()
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				listTargets(ha)
+				r := httptest.NewRequest("GET", fmt.Sprintf("http://p0.client-%d:80/metrics", i), nil)
+				r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.01")
+				ha.ServeHTTP(httptest.NewRecorder(), r)
+			}
+		}(i)
+	}
+
+	var clients sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			// clients share fqdns so they replace each other
+			fqdn := fmt.Sprintf("client-%d", i%4)
+			var ticket string
+			for j := 0; j < 10; j++ {
+				session, ctlConn, issued, err := dialTestClient(s.l.Addr().String(), fqdn, "", ticket)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if j%2 == 0 {
+					ticket = issued
+				}
+				for p := 0; p < 3; p++ {
+					util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte(fmt.Sprintf("p%d", p)))
+				}
+				util.WriteMsg(ctlConn, util.MsgTypeDeregister, []byte("p1"))
+				session.Close()
+			}
+		}(i)
+	}
+	clients.Wait()
+
+	for i := 0; i < 100 && len(s.reg.coordinators()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	readers.Wait()
+
+	assert.Empty(t, s.reg.coordinators())
+	assert.Empty(t, listTargets(ha))
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(s.reg)
+	assert.Equal(t, float64(0), gaugeValue(t, reg, "pushprox_targets"))
+	assert.Equal(t, float64(0), gaugeValue(t, reg, "pushprox_clients"))
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gatherer, name string) float64 {
+	mfs, err := g.Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.Metric[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Labels registered by clients with the settings of the scrape of a process, named
+// like the labels Prometheus takes them from.
+const (
+	jobLabel            = "job"
+	scrapeIntervalLabel = "__scrape_interval__"
+	scrapeTimeoutLabel  = "__scrape_timeout__"
+	metricsPathLabel    = "__metrics_path__"
+
+	defaultJob = "pushprox"
+)
+
+type scrapeConfigs struct {
+	ScrapeConfigs []*scrapeConfig `yaml:"scrape_configs"`
+}
+
+type scrapeConfig struct {
+	JobName        string          `yaml:"job_name"`
+	ScrapeInterval string          `yaml:"scrape_interval,omitempty"`
+	ScrapeTimeout  string          `yaml:"scrape_timeout,omitempty"`
+	MetricsPath    string          `yaml:"metrics_path,omitempty"`
+	ProxyURL       string          `yaml:"proxy_url"`
+	StaticConfigs  []*staticConfig `yaml:"static_configs"`
+}
+
+type staticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// handleScrapeConfigs renders Prometheus scrape_configs scraping the targets through the proxy,
+// one job per value of the job label registered by the clients. The scrape interval, timeout
+// and metrics path registered for a process are set on the job if all its targets agree, and
+// on the target otherwise. The query parameters of targetFilter select a subset of the targets.
+func (h *httpHandler) handleScrapeConfigs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTargetFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proxyURL := h.s.advertiseURL
+	if proxyURL == "" {
+		proxyURL = "http://" + r.Host + "/"
+	}
+	var targets []*Target
+	now := time.Now()
+	for _, t := range listedTargets(h.s.reg.Targets(), false) {
+		if filter.matches(t, targetLabels(t, now)) {
+			targets = append(targets, t)
+		}
+	}
+	b, err := yaml.Marshal(&scrapeConfigs{ScrapeConfigs: renderScrapeConfigs(targets, proxyURL)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+	level.Info(h.logger).Log("msg", "Responded to /scrape_configs", "target_count", len(targets))
+}
+
+func renderScrapeConfigs(targets []*Target, proxyURL string) []*scrapeConfig {
+	byJob := map[string][]*Target{}
+	for _, t := range targets {
+		job := t.Labels[jobLabel]
+		if job == "" {
+			job = defaultJob
+		}
+		byJob[job] = append(byJob[job], t)
+	}
+	jobs := make([]string, 0, len(byJob))
+	for job := range byJob {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+
+	configs := make([]*scrapeConfig, 0, len(jobs))
+	for _, job := range jobs {
+		targets := byJob[job]
+		sc := &scrapeConfig{
+			JobName:        job,
+			ScrapeInterval: commonSetting(targets, scrapeIntervalLabel),
+			ScrapeTimeout:  commonSetting(targets, scrapeTimeoutLabel),
+			MetricsPath:    commonSetting(targets, metricsPathLabel),
+			ProxyURL:       proxyURL,
+		}
+		byLabels := map[string]*staticConfig{}
+		for _, t := range targets {
+			labels := map[string]string{}
+			for name, value := range t.Labels {
+				if name == jobLabel || strings.HasPrefix(name, "__") || !model.LabelName(name).IsValid() {
+					continue
+				}
+				labels[name] = value
+			}
+			for name, common := range map[string]string{
+				scrapeIntervalLabel: sc.ScrapeInterval,
+				scrapeTimeoutLabel:  sc.ScrapeTimeout,
+				metricsPathLabel:    sc.MetricsPath,
+			} {
+				if v := setting(t, name); v != "" && common == "" {
+					labels[name] = v
+				}
+			}
+			key := toLabelSet(labels).String()
+			if byLabels[key] == nil {
+				byLabels[key] = &staticConfig{Labels: labels}
+				sc.StaticConfigs = append(sc.StaticConfigs, byLabels[key])
+			}
+			byLabels[key].Targets = append(byLabels[key].Targets, t.Address())
+		}
+		configs = append(configs, sc)
+	}
+	return configs
+}
+
+// setting returns the valid value of the scrape setting registered for t with the label name.
+func setting(t *Target, name string) string {
+	v := t.Labels[name]
+	switch name {
+	case scrapeIntervalLabel, scrapeTimeoutLabel:
+		if _, err := model.ParseDuration(v); err != nil {
+			return ""
+		}
+	case metricsPathLabel:
+		if !strings.HasPrefix(v, "/") {
+			return ""
+		}
+	}
+	return v
+}
+
+// commonSetting returns the scrape setting of the label name if all targets agree on it.
+func commonSetting(targets []*Target, name string) string {
+	v := setting(targets[0], name)
+	for _, t := range targets[1:] {
+		if setting(t, name) != v {
+			return ""
+		}
+	}
+	return v
+}
+
+func toLabelSet(labels map[string]string) model.LabelSet {
+	ls := make(model.LabelSet, len(labels))
+	for k, v := range labels {
+		ls[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return ls
+}
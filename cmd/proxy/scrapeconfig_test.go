@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestScrapeConfigs(t *testing.T) {
+	reg := newRegistry()
+	c := newCoordinator(log.NewNopLogger(), "client", "", newTicket(), 0, reg)
+	reg.update("client", func(*Coordinator) *Coordinator { return c })
+	c.addScrapeTarget("node", map[string]string{"job": "node", "__scrape_interval__": "30s", "team": "infra"})
+	c.addScrapeTarget("app", map[string]string{"job": "app", "__scrape_interval__": "15s", "__scrape_timeout__": "10s", "__metrics_path__": "/stats"})
+	c.addScrapeTarget("app2", map[string]string{"job": "app", "__scrape_interval__": "1m", "__scrape_timeout__": "10s"})
+	c.addScrapeTarget("other", map[string]string{"__scrape_interval__": "bogus"})
+	h := newHttpHandler(&server{reg: reg}, log.NewNopLogger())
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/scrape_configs", nil)
+	req.Host = "proxy:8080"
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+	var got scrapeConfigs
+	assert.NoError(t, yaml.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, []*scrapeConfig{
+		{
+			JobName:       "app",
+			ScrapeTimeout: "10s",
+			ProxyURL:      "http://proxy:8080/",
+			StaticConfigs: []*staticConfig{
+				{Targets: []string{"app.client:80"}, Labels: map[string]string{"__scrape_interval__": "15s", "__metrics_path__": "/stats"}},
+				{Targets: []string{"app2.client:80"}, Labels: map[string]string{"__scrape_interval__": "1m"}},
+			},
+		},
+		{
+			JobName:        "node",
+			ScrapeInterval: "30s",
+			ProxyURL:       "http://proxy:8080/",
+			StaticConfigs:  []*staticConfig{{Targets: []string{"node.client:80"}, Labels: map[string]string{"team": "infra"}}},
+		},
+		{
+			JobName:       "pushprox",
+			ProxyURL:      "http://proxy:8080/",
+			StaticConfigs: []*staticConfig{{Targets: []string{"other.client:80"}}},
+		},
+	}, got.ScrapeConfigs)
+
+	h.s.advertiseURL = "https://pushprox.example/"
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/scrape_configs?process=node", nil))
+	got = scrapeConfigs{}
+	assert.NoError(t, yaml.Unmarshal(rec.Body.Bytes(), &got))
+	if assert.Len(t, got.ScrapeConfigs, 1) {
+		assert.Equal(t, "https://pushprox.example/", got.ScrapeConfigs[0].ProxyURL)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type matchType int
+
+const (
+	matchEqual matchType = iota
+	matchNotEqual
+	matchRegexp
+	matchNotRegexp
+)
+
+var matchOps = map[string]matchType{
+	"=":  matchEqual,
+	"!=": matchNotEqual,
+	"=~": matchRegexp,
+	"!~": matchNotRegexp,
+}
+
+// labelMatcher matches the value of a label like a matcher of a PromQL selector,
+// a missing label has the empty value.
+type labelMatcher struct {
+	name  string
+	typ   matchType
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(labels map[string]string) bool {
+	v := labels[m.name]
+	switch m.typ {
+	case matchEqual:
+		return v == m.value
+	case matchNotEqual:
+		return v != m.value
+	case matchRegexp:
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// parseSelector parses the label matchers of a PromQL selector, i.e {team="infra",env=~"prod|stage"}.
+// Metric names are not supported, there are no metrics to select.
+func parseSelector(s string) ([]*labelMatcher, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("selector %q must be enclosed in braces", s)
+	}
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+	var matchers []*labelMatcher
+	for rest != "" {
+		i := 0
+		for i < len(rest) && isLabelNameChar(rest[i], i == 0) {
+			i++
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("expected label name at %q", rest)
+		}
+		m := &labelMatcher{name: rest[:i]}
+		rest = strings.TrimSpace(rest[i:])
+
+		var op string
+		for _, o := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("expected match operator after %q", m.name)
+		}
+		m.typ = matchOps[op]
+		rest = strings.TrimSpace(rest[len(op):])
+
+		value, n, err := unquote(rest)
+		if err != nil {
+			return nil, fmt.Errorf("bad value of %q: %v", m.name, err)
+		}
+		m.value = value
+		rest = strings.TrimSpace(rest[n:])
+		if m.typ == matchRegexp || m.typ == matchNotRegexp {
+			if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("bad regexp of %q: %v", m.name, err)
+			}
+		}
+		matchers = append(matchers, m)
+
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("expected comma at %q", rest)
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("selector %q has no matchers", s)
+	}
+	return matchers, nil
+}
+
+func isLabelNameChar(c byte, first bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || !first && c >= '0' && c <= '9'
+}
+
+// unquote reads the string literal s starts with, quoted with ", ' or `.
+// It returns the value and the length of the literal.
+func unquote(s string) (string, int, error) {
+	if s == "" {
+		return "", 0, fmt.Errorf("expected string")
+	}
+	q := s[0]
+	if q != '"' && q != '\'' && q != '`' {
+		return "", 0, fmt.Errorf("expected quoted string at %q", s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && q != '`':
+			i++
+		case s[i] == q:
+			lit := s[:i+1]
+			if q == '\'' {
+				lit = doubleQuote(s[1:i])
+			}
+			v, err := strconv.Unquote(lit)
+			return v, i + 1, err
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string %q", s)
+}
+
+// doubleQuote turns the body of a single quoted literal into a double quoted one,
+// strconv only takes single characters in single quotes.
+func doubleQuote(body string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\' && i+1 < len(body):
+			if body[i+1] != '\'' {
+				b.WriteByte('\\')
+			}
+			i++
+			b.WriteByte(body[i])
+		case body[i] == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(body[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{"team": "infra", "env": "prod", "quote": `it's "q"`}
+	for _, tc := range []struct {
+		selector string
+		match    bool
+	}{
+		{`{team="infra"}`, true},
+		{`{ team = "infra" , env=~"prod|stage" }`, true},
+		{`{team!="infra"}`, false},
+		{`{env!~"st.*"}`, true},
+		{`{env=~"pro"}`, false},
+		{`{missing=""}`, true},
+		{`{team='infra'}`, true},
+		{`{quote='it\'s "q"'}`, true},
+		{"{quote=`it's \"q\"`}", true},
+	} {
+		matchers, err := parseSelector(tc.selector)
+		if assert.NoError(t, err, tc.selector) {
+			assert.Equal(t, tc.match, matchAll(matchers, labels), tc.selector)
+		}
+	}
+
+	for _, bad := range []string{``, `team="infra"`, `{}`, `{team}`, `{team=infra}`, `{team="infra" env="prod"}`, `{team=~"("}`, `{1team="x"}`, `{team="infra}`} {
+		_, err := parseSelector(bad)
+		assert.Error(t, err, bad)
+	}
+}
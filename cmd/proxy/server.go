@@ -2,15 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/log"
@@ -18,7 +16,6 @@ import (
 	"github.com/hashicorp/yamux"
 	"github.com/prometheus-community/pushprox/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
@@ -27,28 +24,50 @@ import (
 
 var (
 	listenPxyAddress     = kingpin.Flag("web.proxy-address", "Address to listen on for proxy requests.").Default(":8080").String()
+	advertiseURL         = kingpin.Flag("web.advertise-url", "URL Prometheus reaches the proxy at, used as proxy_url of /scrape_configs. Defaults to the host of the request.").String()
 	listenServerAddress  = kingpin.Flag("web.server-address", "Address to listen on for client requests.").Default(":7080").String()
 	maxScrapeTimeout     = kingpin.Flag("scrape.max-timeout", "Any scrape with a timeout higher than this will have to be clamped to this.").Default("5m").Duration()
 	defaultScrapeTimeout = kingpin.Flag("scrape.default-timeout", "If a scrape lacks a timeout, use this value.").Default("15s").Duration()
+	leaseTTL             = kingpin.Flag("registry.lease-ttl", "How long a registration of a client supporting leases lives unless renewed, at least 1s as clients get it in whole seconds, 0 disables leases.").Default("90s").Duration()
+	tunnelCompressions   = kingpin.Flag("tunnel.compression", "Compressions of scrape bodies in the tunnel accepted from clients, zstd and gzip, comma separated or none.").Default("zstd,gzip").String()
+	cacheWindow          = kingpin.Flag("cache.window", "Scrapes of a target within this window share one scrape of the client, 0 disables the cache.").Default("0s").Duration()
+	cacheStaleIfError    = kingpin.Flag("cache.stale-if-error", "Answer a failed scrape with the last successful response of the target up to this age, 0 disables it.").Default("0s").Duration()
+	clientMaxInflight    = kingpin.Flag("limits.client-max-inflight", "Maximum number of scrapes in flight per client, 0 is unlimited.").Default("0").Int()
+	clientMaxQueue       = kingpin.Flag("limits.client-max-queue", "Maximum number of scrapes per client waiting for one in flight to finish.").Default("100").Int()
+	globalMaxInflight    = kingpin.Flag("limits.max-inflight", "Maximum number of scrapes in flight over all clients, 0 is unlimited.").Default("0").Int()
+	globalMaxQueue       = kingpin.Flag("limits.max-queue", "Maximum number of scrapes over all clients waiting for one in flight to finish.").Default("1000").Int()
+	limitRejectStatus    = kingpin.Flag("limits.reject-status", "HTTP status of scrapes rejected as the queue is full or they timed out waiting, 503 or 429.").Default("503").Enum("503", "429")
+	statsMaxTargets      = kingpin.Flag("stats.max-targets", "Maximum number of targets scrape statistics are kept for.").Default("10000").Int()
+	statsTargetUp        = kingpin.Flag("stats.target-up", "Export pushprox_target_up, whether the last scrape of a target through the proxy succeeded.").Bool()
+	staleRetention       = kingpin.Flag("registry.stale-retention", "How long targets are kept as stale after their lease lapsed.").Default("1h").Duration()
+	stateFile            = kingpin.Flag("registry.state-file", "File to persist the registered targets to, so they are served while clients reconnect after a restart. Disabled if empty.").String()
+	stateSyncInterval    = kingpin.Flag("registry.state-sync-interval", "How often changes of the registered targets are written to the state file.").Default("15s").Duration()
+	restorePeriod        = kingpin.Flag("registry.restore-period", "How long targets restored from the state file are served as stale while waiting for their clients to register them again.").Default("5m").Duration()
+	fileSDPath           = kingpin.Flag("file-sd.path", "File to write the targets to for file_sd_configs whenever they change, YAML if it ends with .yml or .yaml and JSON otherwise. Disabled if empty.").String()
+	fileSDSplitLabel     = kingpin.Flag("file-sd.split-label", "Label registered by the clients, i.e job or tenant, to additionally split the targets into one file per value, <file>_<value>.<ext>.").String()
+	fileSDInterval       = kingpin.Flag("file-sd.min-interval", "Minimum time between two writes of the file_sd files.").Default("1s").Duration()
+	consulDatacenter     = kingpin.Flag("consul.datacenter", "Datacenter reported by the Consul catalog API emulation for consul_sd_configs.").Default("dc1").String()
+	tlsCertFile          = kingpin.Flag("connect.tls-cert-file", "Certificate to terminate TLS of https scrapes tunneled with CONNECT. If empty, TLS is passed through to the https endpoint on the client.").String()
+	tlsKeyFile           = kingpin.Flag("connect.tls-key-file", "Key of the certificate to terminate TLS of https scrapes tunneled with CONNECT.").String()
+	dnsListenAddress     = kingpin.Flag("dns.listen-address", "Address to serve DNS SRV and A records of the targets on for dns_sd_configs, over UDP and TCP. Disabled if empty.").String()
+	dnsZone              = kingpin.Flag("dns.zone", "Zone the DNS server is authoritative for.").Default("pushprox.").String()
+	dnsAdvertiseIP       = kingpin.Flag("dns.advertise-ip", "IPv4 address of the proxy answered to A queries of the targets in the DNS zone.").String()
+	dnsTTL               = kingpin.Flag("dns.ttl", "TTL of the DNS records.").Default("30s").Duration()
+	resumeGrace          = kingpin.Flag("session.resume-grace", "How long the targets of a disconnected client are kept for it to resume its session, 0 drops them at once.").Default("30s").Duration()
 
 	authTokens    = kingpin.Flag("auth.tokens", "String contains comma split tokens, i.e pwd-a,token-x").String()
 	authTokenFile = kingpin.Flag("auth.token-file", "File contains comma split tokens, i.e pwd-a,token-x. If specified, auth.tokens will be ignored").String()
+
+	muxConfig util.MuxConfig
 )
 
 const (
 	namespace                     = "pushprox" // For Prometheus metrics.
 	connReadTimeout time.Duration = 10 * time.Second
+	connIdleTimeout time.Duration = 5 * time.Minute
 )
 
 var (
-	knownTargets = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "targets",
-			Help:      "Number of known pushprox targets.",
-		},
-	)
-
 	httpProxyHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: namespace,
@@ -62,18 +81,44 @@ func init() {
 }
 
 type server struct {
-	l      net.Listener
-	lg     log.Logger
-	tokens []string
+	l         net.Listener
+	lg        log.Logger
+	tokens    []string
+	muxConfig *yamux.Config
+	sessions  *sessionTracker
+	reg       *registry
+	dnsZone   string       // targets are scraped as <process_name>.<fqdn>.<dnsZone> as well
+	tlsConfig *tls.Config  // terminates TLS of CONNECT requests, passed through to the client if nil
+	cache     *scrapeCache // nil unless scrapes are cached
+
+	compressions []string // of scrape bodies in the tunnel, offered by clients
+
+	advertiseURL string // proxy_url of generated scrape configs
 
-	mu      sync.Mutex
-	remotes map[string]*Coordinator
+	resumeGrace    time.Duration
+	leaseTTL       time.Duration
+	staleRetention time.Duration
 }
 
 func (s *server) StartServe() {
+	go s.dropStaleTargets()
 	s.HandleListener()
 }
 
+// dropStaleTargets periodically forgets the targets whose lease lapsed longer than the retention ago.
+func (s *server) dropStaleTargets() {
+	if s.leaseTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.leaseTTL / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, c := range s.reg.coordinators() {
+			c.dropStaleTargets(now, s.staleRetention)
+		}
+	}
+}
+
 func (s *server) HandleListener() {
 	for {
 		con, err := s.l.Accept()
@@ -83,13 +128,14 @@ func (s *server) HandleListener() {
 		}
 		ctx := context.Background()
 		go func() {
-			session, err := yamux.Server(con, nil)
+			cc := &countingConn{Conn: con}
+			session, err := yamux.Server(cc, s.muxConfig)
 			if err != nil {
 				level.Error(s.lg).Log("msg", "failed to create mux connection: %v", err)
 				con.Close()
 				return
 			}
-			as := &authSession{Session: session}
+			as := &authSession{Session: session, conn: cc}
 			for {
 				stream, err := session.AcceptStream()
 				if err != nil {
@@ -113,9 +159,14 @@ func (s *server) HandleListener() {
 	}
 }
 
-type authSession struct {
-	token atomic.Value
-	*yamux.Session
+// rttProbeInterval returns how often the round trip time of client sessions is measured,
+// false if it isn't as the keepalive of the sessions is disabled.
+func (s *server) rttProbeInterval() (time.Duration, bool) {
+	cfg := s.muxConfig
+	if cfg == nil {
+		cfg = yamux.DefaultConfig()
+	}
+	return cfg.KeepAliveInterval, cfg.EnableKeepAlive
 }
 
 func (s *server) handleConnection(ctx context.Context, session *authSession, conn net.Conn) {
@@ -151,38 +202,81 @@ func (s *server) handleConnection(ctx context.Context, session *authSession, con
 			conn.Close()
 			return
 		}
-		err = util.WriteMsg(cryptoConn, util.MsgTypeNewMachineOK, []byte{})
+		fqdn := newClientMsg.Fqdn
+		var ttl time.Duration
+		if newClientMsg.Leases {
+			ttl = s.leaseTTL
+		}
+		client := clientInfo{
+			RemoteAddr:  session.RemoteAddr().String(),
+			TokenID:     util.TokenID(token),
+			Version:     newClientMsg.Version,
+			ConnectedAt: time.Now(),
+		}
+		// Whether the session is resumed is decided and the connection attached in one
+		// critical section, so the coordinator can't be replaced or stopped in between.
+		var (
+			c      *Coordinator
+			ticket string
+			fresh  bool
+		)
+		s.reg.update(fqdn, func(old *Coordinator) *Coordinator {
+			var ok bool
+			if old != nil && old.resumable(token, newClientMsg.Ticket) {
+				if ticket, ok = old.attach(cryptoConn, ttl, client); ok {
+					level.Info(s.lg).Log("msg", "client resumed session", "fqdn", fqdn)
+				}
+			}
+			if !ok && old != nil && old.adopt(token, newTicket()) {
+				if ticket, ok = old.attach(cryptoConn, ttl, client); ok {
+					level.Info(s.lg).Log("msg", "client reconciled restored targets", "fqdn", fqdn)
+				}
+			}
+			if ok {
+				c = old
+				return c
+			}
+			if old != nil {
+				go old.stop()
+			}
+			c, fresh = newCoordinator(s.lg, fqdn, token, newTicket(), s.resumeGrace, s.reg), true
+			ticket, _ = c.attach(cryptoConn, ttl, client)
+			return c
+		})
+
+		compression := util.NegotiateCompression(newClientMsg.Compressions, s.compressions)
+		okMsg, err := (&util.NewMachineOKMessage{Ticket: ticket, LeaseTTLSeconds: int64(ttl.Seconds()), RegisterMetadata: true, Compression: compression}).Marshal()
+		if err == nil {
+			err = c.greet(cryptoConn, util.MsgTypeNewMachineOK, okMsg)
+		}
 		if err != nil {
-			level.Error(s.lg).Log("msg", "write MsgTypeNewMachineOK", "err", err)
-			cryptoConn.Close()
+			level.Error(s.lg).Log("msg", "write MsgTypeNewMachineOK", "fqdn", fqdn, "err", err)
+			// the client didn't learn about the session, a new coordinator is dropped again
+			if fresh {
+				cryptoConn.Close()
+				c.stop()
+			} else {
+				c.detach(cryptoConn)
+			}
 			return
 		}
 
-		fqdn := newClientMsg.Fqdn
-
-		s.mu.Lock()
-		if old := s.remotes[fqdn]; old != nil {
-			go old.stop()
-		}
-		c := &Coordinator{
-			lg:           s.lg,
-			fqdn:         fqdn,
-			known:        map[string]time.Time{},
-			ctlConn:      cryptoConn,
-			scrapeConnCh: make(chan net.Conn, 10),
+		s.sessions.track(fqdn, session)
+		go func() {
+			<-session.CloseChan()
+			s.sessions.untrack(fqdn, session)
+		}()
+		if interval, ok := s.rttProbeInterval(); ok {
+			session.probe.Do(func() { go session.probeRTT(interval) })
 		}
-		s.remotes[fqdn] = c
-		go c.start()
-		s.mu.Unlock()
 	case util.MsgTypeNewScrapeConn:
 		fqdn := string(msg)
-		var c *Coordinator
-		s.mu.Lock()
-		if c = s.remotes[fqdn]; c == nil {
+		c := s.reg.get(fqdn)
+		if c == nil {
 			level.Warn(s.lg).Log("msg", "Error can't find coordinator", "machine", fqdn, "addr", conn.RemoteAddr().String())
 			conn.Close()
+			return
 		}
-		s.mu.Unlock()
 		c.registerScrapeConn(conn)
 	default:
 		level.Warn(s.lg).Log("msg", fmt.Sprintf("Error message type for the new connection [%s]", conn.RemoteAddr().String()))
@@ -211,8 +305,14 @@ func newHttpHandler(s *server, lg log.Logger) *httpHandler {
 	h := &httpHandler{s: s, logger: lg, mux: http.NewServeMux()}
 	// api handlers
 	handlers := map[string]http.HandlerFunc{
-		"/targets": h.handleListTargets,
-		"/metrics": promhttp.Handler().ServeHTTP,
+		"/targets":        h.handleListTargets,
+		"/scrape_configs": h.handleScrapeConfigs,
+		"/scrape/":        h.handlePathScrape,
+		"/stats":          h.handleStats,
+		"/metrics":        promhttp.Handler().ServeHTTP,
+	}
+	for path, handlerFunc := range newConsulAPI(s.reg, *consulDatacenter).handlers() {
+		handlers[path] = handlerFunc
 	}
 	for path, handlerFunc := range handlers {
 		h.mux.Handle(path, handlerFunc)
@@ -221,55 +321,86 @@ func newHttpHandler(s *server, lg log.Logger) *httpHandler {
 	return h
 }
 
-type targetGroup struct {
-	Targets []string          `json:"targets"`
-	Labels  map[string]string `json:"labels"`
-}
-
-// handleListTargets handles requests to list available clients as a JSON array.
-func (h *httpHandler) handleListTargets(w http.ResponseWriter, r *http.Request) {
-	var known []string
-	for _, c := range h.s.remotes {
-		known = append(known, c.KnownTargets()...)
+// newHTTPServer returns a server of requests of Prometheus, reading a request may take up to the
+// longest scrape, as a read deadline passing cancels the request in flight.
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: connReadTimeout,
+		ReadTimeout:       *maxScrapeTimeout + connReadTimeout,
+		IdleTimeout:       connIdleTimeout,
 	}
-	targets := make([]*targetGroup, 0, len(known))
-	for _, k := range known {
-		targets = append(targets, &targetGroup{Targets: []string{k}})
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(targets)
-	level.Info(h.logger).Log("msg", "Responded to /clients", "client_count", len(known))
 }
 
 // ServeHTTP discriminates between proxy requests (e.g. from Prometheus) and other requests (e.g. from the Client).
 func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Host != "" { // Proxy request
+	if r.Method == http.MethodConnect { // Proxy request of a https target
+		h.handleConnect(w, r)
+	} else if r.URL.Host != "" { // Proxy request
 		h.proxy.ServeHTTP(w, r)
 	} else { // Non-proxy requests
 		h.mux.ServeHTTP(w, r)
 	}
 }
 
+// handlePathScrape handles scrapes of callers that can't use the proxy, /scrape/<fqdn>/<process_name>[/<path>]
+// is scraped like http://<process_name>.<fqdn>:80[/<path>].
+func (h *httpHandler) handlePathScrape(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/scrape/"), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "expected /scrape/<fqdn>/<process_name>", http.StatusBadRequest)
+		return
+	}
+	r = r.Clone(r.Context())
+	r.Host = parts[1] + "." + parts[0] + ":80"
+	r.URL.Scheme, r.URL.Host, r.URL.Path, r.URL.RawPath = "http", r.Host, "/", ""
+	if len(parts) == 3 {
+		r.URL.Path += parts[2]
+	}
+	h.proxy.ServeHTTP(w, r)
+}
+
 func (h *httpHandler) handleScrape(w http.ResponseWriter, r *http.Request) {
-	h.s.mu.Lock()
-	// <process_name>.<fqdn>:80
+	c, code := h.resolve(r)
+	if c == nil {
+		w.WriteHeader(code)
+		return
+	}
+	scrape := c.handleScrape
+	if strings.HasPrefix(r.Host, fanoutProcess+".") {
+		scrape = c.handleFanout
+	}
+	if h.s.cache != nil {
+		h.s.cache.serve(w, r, scrape)
+		return
+	}
+	scrape(w, r)
+}
+
+// resolve returns the coordinator of the target of r, <process_name>.<fqdn>:<port>, or the
+// status code to respond with. Targets of DNS SRV records are rewritten to the host the client expects.
+func (h *httpHandler) resolve(r *http.Request) (*Coordinator, int) {
 	host, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, http.StatusBadRequest
 	}
 	parts := strings.SplitN(host, ".", 2)
 	if len(parts) != 2 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest
+	}
+	c := h.s.reg.get(parts[1])
+	if c == nil && h.s.dnsZone != "" {
+		// a target of a DNS SRV record, the client expects <process_name>.<fqdn>
+		fqdn := strings.TrimSuffix(strings.TrimSuffix(parts[1], "."), "."+strings.TrimSuffix(h.s.dnsZone, "."))
+		if c = h.s.reg.get(fqdn); c != nil {
+			r.Host = strings.Replace(r.Host, host, parts[0]+"."+fqdn, 1)
+			r.URL.Host = r.Host
+		}
 	}
-	c := h.s.remotes[parts[1]]
-	h.s.mu.Unlock()
 	if c == nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return nil, http.StatusNotFound
 	}
-	c.handleScrape(w, r)
+	return c, http.StatusOK
 }
 
 func getAuthTokens() ([]string, error) {
@@ -290,10 +421,16 @@ func getAuthTokens() ([]string, error) {
 func main() {
 	promlogConfig := promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, &promlogConfig)
+	util.AddMuxFlags(kingpin.CommandLine, &muxConfig)
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 	logger := promlog.New(&promlogConfig)
 	kingpin.Parse()
+	muxCfg, err := muxConfig.YamuxConfig()
+	if err != nil {
+		level.Error(logger).Log("msg", "bad mux args", "error", err)
+		os.Exit(1)
+	}
 	l, err := net.Listen("tcp", *listenServerAddress)
 	if err != nil {
 		level.Error(logger).Log("error", err)
@@ -304,17 +441,65 @@ func main() {
 		level.Error(logger).Log("msg", "bad token args", "error", err)
 		os.Exit(1)
 	}
+	compressions, err := util.ParseCompressions(*tunnelCompressions)
+	if err != nil {
+		level.Error(logger).Log("msg", "bad tunnel compression", "err", err)
+		os.Exit(1)
+	}
+	if *leaseTTL < 0 || *leaseTTL > 0 && *leaseTTL < time.Second {
+		level.Error(logger).Log("msg", "bad lease ttl, it's either 0 or at least 1s", "ttl", *leaseTTL)
+		os.Exit(1)
+	}
 	s := &server{
-		l:       l,
-		lg:      logger,
-		remotes: map[string]*Coordinator{},
-		tokens:  tokens,
+		l:   l,
+		lg:  logger,
+		reg: newRegistry(),
+
+		resumeGrace:    *resumeGrace,
+		leaseTTL:       *leaseTTL,
+		staleRetention: *staleRetention,
+		tokens:         tokens,
+		muxConfig:      muxCfg,
+		advertiseURL:   *advertiseURL,
+		sessions:       newSessionTracker(),
+		compressions:   compressions,
+	}
+	prometheus.MustRegister(s.sessions, s.reg)
+	if *stateFile != "" {
+		if err := s.restoreState(*stateFile, *restorePeriod); err != nil && !os.IsNotExist(err) {
+			level.Error(logger).Log("msg", "failed to restore state", "path", *stateFile, "err", err)
+		}
+		go s.syncState(*stateFile, *stateSyncInterval)
+	}
+	globalLimiter = newScrapeLimiter(scopeGlobal, *globalMaxInflight, *globalMaxQueue)
+	if *cacheWindow > 0 || *cacheStaleIfError > 0 {
+		s.cache = newScrapeCache(*cacheWindow, *cacheStaleIfError)
+	}
+	if *tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to load TLS certificate", "err", err)
+			os.Exit(1)
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if *dnsListenAddress != "" {
+		s.dnsZone = *dnsZone
+		if err := s.serveDNS(*dnsListenAddress, *dnsZone, *dnsAdvertiseIP, *dnsTTL); err != nil {
+			level.Error(logger).Log("msg", "failed to start DNS server", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *fileSDPath != "" {
+		go newFileSD(logger, s.reg, *fileSDPath, *fileSDSplitLabel).run(*fileSDInterval)
 	}
 	s.lg.Log("msg", fmt.Sprintf("handle proxyc request on %s", *listenServerAddress))
 	ha := newHttpHandler(s, log.NewLogfmtLogger(os.Stdout))
 	go func() {
 		s.lg.Log("msg", fmt.Sprintf("handle prometheus request on %s", *listenPxyAddress))
-		http.ListenAndServe(*listenPxyAddress, ha)
+		srv := newHTTPServer(ha)
+		srv.Addr = *listenPxyAddress
+		srv.ListenAndServe()
 	}()
 	s.StartServe()
 }
@@ -1,30 +1,556 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
-	"github.com/go-kit/log"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/yamux"
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-func TestServer(t *testing.T) {
-	l, err := net.Listen("tcp", ":7080")
-	if err != nil {
+func TestMain(m *testing.M) {
+	// populate flag defaults
+	if _, err := kingpin.CommandLine.Parse(nil); err != nil {
 		panic(err)
 	}
+	os.Exit(m.Run())
+}
+
+// dialTestClient connects to the proxy at addr and performs the handshake of a client,
+// it returns the resumption ticket issued by the proxy.
+func dialTestClient(addr, fqdn, token, ticket string) (*yamux.Session, net.Conn, string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ctlConn, err := session.Open()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ts := time.Now().Unix()
+	msg, _ := (&util.NewClientMessage{Fqdn: fqdn, Timestamp: ts, Auth: util.SignAuth(token, ts), Ticket: ticket}).Marshal()
+	if err = util.WriteMsg(ctlConn, util.MsgTypeNewMachine, msg); err != nil {
+		return nil, nil, "", err
+	}
+	ctlConn, err = util.WrapAsCryptoConn(ctlConn, []byte(token))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	typ, msg, err := util.ReadMsg(ctlConn)
+	if err != nil || typ != util.MsgTypeNewMachineOK {
+		return nil, nil, "", fmt.Errorf("handshake failed, got %q: %v", typ, err)
+	}
+	okMsg, err := util.UnmarshalIntoNewMachineOKMessage(msg)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return session, ctlConn, okMsg.Ticket, nil
+}
+
+// serveTestScrapes answers the scrape connection requests of the proxy on ctlConn like a client,
+// the scrapes are served by handler and CONNECT tunnels echo what they receive.
+func serveTestScrapes(session *yamux.Session, ctlConn net.Conn, fqdn, token string, handler http.Handler) {
+	for {
+		typ, _, err := util.ReadMsg(ctlConn)
+		if err != nil {
+			return
+		}
+		if typ != util.MsgTypeReqScrapeConn {
+			continue
+		}
+		stream, err := session.Open()
+		if err != nil {
+			return
+		}
+		sconn, err := util.WrapAsCryptoConn(stream, []byte(token))
+		if err != nil {
+			return
+		}
+		if err := util.WriteMsg(sconn, util.MsgTypeNewScrapeConn, []byte(fqdn)); err != nil {
+			return
+		}
+		go func() {
+			br := bufio.NewReader(sconn)
+			for {
+				r, err := http.ReadRequest(br)
+				if err != nil {
+					sconn.Close()
+					return
+				}
+				if r.Method == http.MethodConnect {
+					io.WriteString(sconn, "HTTP/1.1 200 Connection established\r\n\r\n")
+					io.Copy(sconn, br)
+					sconn.Close()
+					return
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, r)
+				resp := rec.Result()
+				resp.ContentLength = int64(rec.Body.Len())
+				if err := resp.Write(sconn); err != nil {
+					sconn.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+func newTestServer(t *testing.T, resumeGrace time.Duration) (*server, http.Handler) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
 	s := &server{
-		l:       l,
-		lg:      log.NewLogfmtLogger(os.Stdout),
-		remotes: map[string]*Coordinator{},
-		tokens:  []string{""},
+		l:        l,
+		lg:       log.NewLogfmtLogger(os.Stdout),
+		reg:      newRegistry(),
+		tokens:   []string{""},
+		sessions: newSessionTracker(),
+
+		resumeGrace:    resumeGrace,
+		leaseTTL:       *leaseTTL,
+		staleRetention: *staleRetention,
+	}
+	go s.StartServe()
+	return s, newHttpHandler(s, log.NewLogfmtLogger(os.Stdout))
+}
+
+// waitTargets polls /targets until it lists n targets.
+func waitTargets(h http.Handler, n int) []*targetGroup {
+	var tgs []*targetGroup
+	for i := 0; i < 100; i++ {
+		if tgs = listTargets(h); countTargets(tgs) == n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return tgs
+}
+
+func countTargets(tgs []*targetGroup) int {
+	var n int
+	for _, tg := range tgs {
+		n += len(tg.Targets)
+	}
+	return n
+}
+
+func listTargets(h http.Handler) []*targetGroup {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/targets", nil))
+	var tgs []*targetGroup
+	json.NewDecoder(rec.Body).Decode(&tgs)
+	return tgs
+}
+
+func TestServer(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+
+	tgs := waitTargets(ha, 1)
+	if assert.Len(t, tgs, 1) {
+		assert.Equal(t, []string{"node.client:80"}, tgs[0].Targets)
 	}
-	s.lg.Log("msg", fmt.Sprintf("handle proxyc request on %s", ":7080"))
-	ha := newHttpHandler(s, log.NewLogfmtLogger(os.Stdout))
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(s.sessions)
+	mfs, err := reg.Gather()
+	assert.NoError(t, err)
+	names := map[string]string{}
+	for _, mf := range mfs {
+		names[mf.GetName()] = mf.Metric[0].Label[0].GetValue()
+	}
+	assert.Equal(t, map[string]string{
+		"pushprox_session_streams":              "client",
+		"pushprox_session_rtt_seconds":          "client",
+		"pushprox_session_sent_bytes_total":     "client",
+		"pushprox_session_received_bytes_total": "client",
+	}, names)
+}
+
+func TestSessionResumption(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, ticket, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, ticket)
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+	assert.Len(t, waitTargets(ha, 1), 1)
+	c := s.reg.get("client")
+
+	// targets survive the disconnect
+	session.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, listTargets(ha), 1)
+
+	// a scrape during the gap waits for the client to come back
+	scraped := make(chan int)
 	go func() {
-		s.lg.Log("msg", fmt.Sprintf("handle prometheus request on %s", ":8080"))
-		http.ListenAndServe(":8080", ha)
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://node.client:80/metrics", nil)
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "5")
+		c.handleScrape(rec, r)
+		scraped <- rec.Code
 	}()
-	s.StartServe()
+
+	session, ctlConn, resumed, err := dialTestClient(s.l.Addr().String(), "client", "", ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.Equal(t, ticket, resumed)
+	assert.True(t, c == s.reg.get("client"))
+	assert.Len(t, listTargets(ha), 1)
+
+	typ, _, err := util.ReadMsg(ctlConn)
+	assert.NoError(t, err)
+	assert.Equal(t, util.MsgTypeReqScrapeConn, typ)
+	c.stop()
+	assert.Equal(t, http.StatusInternalServerError, <-scraped)
+
+	// an unknown ticket starts from scratch
+	session, _, fresh, err := dialTestClient(s.l.Addr().String(), "client", "", "bogus")
+	assert.NoError(t, err)
+	assert.NotEqual(t, ticket, fresh)
+	defer session.Close()
+
+	// a coordinator stopping while the client reconnects isn't resumed
+	c = s.reg.get("client")
+	c.mu.Lock()
+	c.stopped = true
+	c.mu.Unlock()
+	_, _, renewed, err := dialTestClient(s.l.Addr().String(), "client", "", fresh)
+	assert.NoError(t, err)
+	assert.NotEqual(t, fresh, renewed)
+	assert.False(t, c == s.reg.get("client"))
+}
+
+func TestTargetLabels(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	msg, _ := (&util.RegisterMessage{Process: "node", Labels: map[string]string{"team": "infra", "app.kubernetes.io/name": "node"}}).Marshal()
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, msg))
+	// clients before metadata support register the bare name
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("app")))
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("web")))
+
+	// the targets of a client share a group unless their labels differ
+	tgs := waitTargets(ha, 3)
+	if !assert.Len(t, tgs, 2) {
+		return
+	}
+	assert.Equal(t, []string{"app.client:80", "web.client:80"}, tgs[0].Targets)
+	assert.Equal(t, []string{"node.client:80"}, tgs[1].Targets)
+
+	labels := tgs[1].Labels
+	assert.Equal(t, "client", labels["__meta_pushprox_fqdn"])
+	assert.NotContains(t, labels, "__meta_pushprox_process")
+	assert.Equal(t, "infra", labels["__meta_pushprox_label_team"])
+	assert.Equal(t, "node", labels["__meta_pushprox_label_app_kubernetes_io_name"])
+	assert.Equal(t, util.TokenID(""), labels["__meta_pushprox_token_id"])
+	assert.Equal(t, session.LocalAddr().String(), labels["__meta_pushprox_client_address"])
+	_, err = time.Parse(time.RFC3339, labels["__meta_pushprox_connected_at"])
+	assert.NoError(t, err)
+	assert.NotContains(t, tgs[0].Labels, "__meta_pushprox_label_team")
+}
+
+func TestPathScrape(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client.example", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+	waitTargets(ha, 1)
+	go serveTestScrapes(session, ctlConn, "client.example", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the timeout is passed on less the time the proxy took
+		timeout, _ := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+		fmt.Fprintf(w, "%s %s %.0f", r.Host, r.URL.Path, timeout)
+	}))
+
+	for path, want := range map[string]string{
+		"/scrape/client.example/node":               "node.client.example:80 / 7",
+		"/scrape/client.example/node/metrics?x=1":   "node.client.example:80 /metrics 7",
+		"/scrape/client.example/node/debug/metrics": "node.client.example:80 /debug/metrics 7",
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "7")
+		ha.ServeHTTP(rec, r)
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+		assert.Equal(t, want, rec.Body.String(), path)
+	}
+
+	for path, code := range map[string]int{
+		"/scrape/client.example":       http.StatusBadRequest,
+		"/scrape/unknown.example/node": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		ha.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, code, rec.Code, path)
+	}
+}
+
+func TestConnectPassthrough(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+	waitTargets(ha, 1)
+	go serveTestScrapes(session, ctlConn, "client", "", http.NotFoundHandler())
+
+	ts := httptest.NewServer(ha)
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT node.client:443 HTTP/1.1\r\nHost: node.client:443\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestConnectPassthroughLimits(t *testing.T) {
+	defer func(timeout time.Duration) { *defaultScrapeTimeout = timeout }(*defaultScrapeTimeout)
+	*defaultScrapeTimeout = 500 * time.Millisecond
+	defer targetStats.forget("tunnel.example", "")
+
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "tunnel.example", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+	waitTargets(ha, 1)
+	s.reg.get("tunnel.example").limiter = newScrapeLimiter(scopeClient, 1, 0)
+	go serveTestScrapes(session, ctlConn, "tunnel.example", "", http.NotFoundHandler())
+
+	ts := httptest.NewServer(ha)
+	defer ts.Close()
+	connect := func() (net.Conn, *bufio.Reader, int) {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "CONNECT node.tunnel.example:443 HTTP/1.1\r\nHost: node.tunnel.example:443\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, br, resp.StatusCode
+	}
+
+	conn, br, code := connect()
+	defer conn.Close()
+	if !assert.Equal(t, http.StatusOK, code) {
+		return
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err)
+
+	// the open tunnel holds the only slot of the client
+	other, _, code := connect()
+	other.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// the idle tunnel is closed and accounted
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	var st *targetStat
+	for i := 0; i < 100 && (st == nil || st.Scrapes < 2); i++ {
+		time.Sleep(10 * time.Millisecond)
+		for _, s := range targetStats.snapshot() {
+			if s.Fqdn == "tunnel.example" {
+				st = s
+			}
+		}
+	}
+	if assert.NotNil(t, st) {
+		assert.Equal(t, uint64(2), st.Scrapes)
+		assert.Equal(t, uint64(4), st.ResponseBytes)
+		assert.Equal(t, map[string]uint64{stageQueue: 1}, st.Errors)
+	}
+}
+
+func TestConnectTerminate(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+	waitTargets(ha, 1)
+	go serveTestScrapes(session, ctlConn, "client", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	}))
+
+	// borrow the certificate of a TLS test server
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsServer.Close()
+	s.tlsConfig = &tls.Config{Certificates: tlsServer.TLS.Certificates}
+	ts := httptest.NewServer(ha)
+	defer ts.Close()
+	proxyURL, _ := url.Parse(ts.URL)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://node.client/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "node.client:443 /metrics", string(body))
+}
+
+func TestFanoutScrape(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for _, process := range []string{"node", "app", "broken", fanoutProcess} {
+		assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte(process)))
+	}
+	waitTargets(ha, 3)
+	go serveTestScrapes(session, ctlConn, "client", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "node.client:80":
+			fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total{code=\"200\"} 3\n")
+		case "app.client:80":
+			fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total{code=\"500\",pushprox_process=\"x\"} 1\n")
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	ha.ServeHTTP(rec, httptest.NewRequest("GET", "/scrape/client/all", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE requests_total counter\n" +
+			`requests_total{code="500",pushprox_process="app"} 1` + "\n" +
+			`requests_total{code="200",pushprox_process="node"} 3` + "\n",
+		`pushprox_process_scrape_success{pushprox_process="app"} 1`,
+		`pushprox_process_scrape_success{pushprox_process="broken"} 0`,
+		`pushprox_process_scrape_success{pushprox_process="node"} 1`,
+		`pushprox_process_scrape_duration_seconds{pushprox_process="broken"}`,
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func TestScrapeCanceled(t *testing.T) {
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+	waitTargets(ha, 1)
+	block := make(chan struct{})
+	go serveTestScrapes(session, ctlConn, "client", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-block
+		}
+		fmt.Fprint(w, "up 1\n")
+	}))
+	defer close(block)
+	c := s.reg.get("client")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scraped := make(chan struct{})
+	go func() {
+		c.handleScrape(httptest.NewRecorder(), httptest.NewRequest("GET", "http://node.client:80/slow", nil).WithContext(ctx))
+		close(scraped)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-scraped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled scrape didn't return")
+	}
+
+	// the connection of the canceled scrape isn't reused
+	c.mu.Lock()
+	pooled := len(c.scrapeConnCh)
+	c.mu.Unlock()
+	assert.Equal(t, 0, pooled)
+	rec := httptest.NewRecorder()
+	c.handleScrape(rec, httptest.NewRequest("GET", "http://node.client:80/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "up 1\n", rec.Body.String())
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sessionStreamsDesc = prometheus.NewDesc(
+		namespace+"_session_streams",
+		"Number of open streams in the tunnel session of a client.",
+		[]string{"fqdn"}, nil,
+	)
+	sessionRTTDesc = prometheus.NewDesc(
+		namespace+"_session_rtt_seconds",
+		"Round trip time of the last ping on the tunnel session of a client.",
+		[]string{"fqdn"}, nil,
+	)
+	sessionSentBytesDesc = prometheus.NewDesc(
+		namespace+"_session_sent_bytes_total",
+		"Bytes sent to a client over its tunnel session.",
+		[]string{"fqdn"}, nil,
+	)
+	sessionReceivedBytesDesc = prometheus.NewDesc(
+		namespace+"_session_received_bytes_total",
+		"Bytes received from a client over its tunnel session.",
+		[]string{"fqdn"}, nil,
+	)
+)
+
+// countingConn counts the bytes read from and written to the underlying connection.
+type countingConn struct {
+	read    uint64 // accessed atomically, first for 64-bit alignment
+	written uint64
+	net.Conn
+}
+
+func (cc *countingConn) Read(b []byte) (n int, err error) {
+	n, err = cc.Conn.Read(b)
+	atomic.AddUint64(&cc.read, uint64(n))
+	return
+}
+
+func (cc *countingConn) Write(b []byte) (n int, err error) {
+	n, err = cc.Conn.Write(b)
+	atomic.AddUint64(&cc.written, uint64(n))
+	return
+}
+
+type authSession struct {
+	rtt int64 // nanoseconds of the last ping, accessed atomically
+
+	token atomic.Value
+	probe sync.Once // starts probeRTT once the client authenticated
+	*yamux.Session
+	conn *countingConn
+}
+
+// probeRTT pings the peer every interval until the session is closed.
+func (as *authSession) probeRTT(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if rtt, err := as.Ping(); err == nil {
+			atomic.StoreInt64(&as.rtt, int64(rtt))
+		}
+		select {
+		case <-as.CloseChan():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sessionTracker keeps the authenticated sessions by fqdn and exports their statistics.
+type sessionTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*authSession
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{sessions: map[string]*authSession{}}
+}
+
+func (t *sessionTracker) track(fqdn string, as *authSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[fqdn] = as
+}
+
+func (t *sessionTracker) untrack(fqdn string, as *authSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions[fqdn] == as {
+		delete(t.sessions, fqdn)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *sessionTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionStreamsDesc
+	ch <- sessionRTTDesc
+	ch <- sessionSentBytesDesc
+	ch <- sessionReceivedBytesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *sessionTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for fqdn, as := range t.sessions {
+		ch <- prometheus.MustNewConstMetric(sessionStreamsDesc, prometheus.GaugeValue,
+			float64(as.NumStreams()), fqdn)
+		ch <- prometheus.MustNewConstMetric(sessionRTTDesc, prometheus.GaugeValue,
+			time.Duration(atomic.LoadInt64(&as.rtt)).Seconds(), fqdn)
+		ch <- prometheus.MustNewConstMetric(sessionSentBytesDesc, prometheus.CounterValue,
+			float64(atomic.LoadUint64(&as.conn.written)), fqdn)
+		ch <- prometheus.MustNewConstMetric(sessionReceivedBytesDesc, prometheus.CounterValue,
+			float64(atomic.LoadUint64(&as.conn.read)), fqdn)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// persistedTarget is a target as written to the state file.
+type persistedTarget struct {
+	Fqdn     string            `json:"fqdn"`
+	Process  string            `json:"process"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	LastSeen time.Time         `json:"lastSeen"`
+}
+
+type persistedState struct {
+	Targets []*persistedTarget `json:"targets"`
+}
+
+// saveState writes targets to the state file at path.
+func saveState(path string, targets []*Target, now time.Time) error {
+	state := persistedState{Targets: make([]*persistedTarget, 0, len(targets))}
+	for _, t := range targets {
+		lastSeen := now
+		if t.Stale {
+			lastSeen = t.LastRenewal
+		}
+		state.Targets = append(state.Targets, &persistedTarget{
+			Fqdn:     t.Fqdn,
+			Process:  t.Process,
+			Labels:   t.Labels,
+			LastSeen: lastSeen,
+		})
+	}
+	b, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path, b, 0600)
+}
+
+func loadState(path string) (*persistedState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state persistedState
+	err = json.Unmarshal(b, &state)
+	return &state, err
+}
+
+// restoreState serves the targets of the state file at path as stale for period,
+// or until their clients reconnect and register them again.
+func (s *server) restoreState(path string, period time.Duration) error {
+	state, err := loadState(path)
+	if err != nil {
+		return err
+	}
+	byFqdn := map[string][]*persistedTarget{}
+	for _, t := range state.Targets {
+		byFqdn[t.Fqdn] = append(byFqdn[t.Fqdn], t)
+	}
+	for fqdn, targets := range byFqdn {
+		c := newCoordinator(s.lg, fqdn, "", "", s.resumeGrace, s.reg)
+		restored := false
+		s.reg.update(fqdn, func(old *Coordinator) *Coordinator {
+			if old != nil {
+				return old
+			}
+			restored = true
+			return c
+		})
+		if restored {
+			c.restore(targets, period)
+		}
+	}
+	level.Info(s.lg).Log("msg", "restored targets from state file", "path", path, "clients", len(byFqdn), "targets", len(state.Targets))
+	return nil
+}
+
+// syncState writes the registry to the state file at path whenever it changed,
+// and at least every ten intervals to keep the last seen times current.
+func (s *server) syncState(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var synced uint64
+	var skipped int
+	for now := range ticker.C {
+		version := s.reg.Version()
+		if version == synced && skipped < 10 {
+			skipped++
+			continue
+		}
+		if err := saveState(path, s.reg.Targets(), now); err != nil {
+			level.Error(s.lg).Log("msg", "failed to write state file", "path", path, "err", err)
+			continue
+		}
+		synced, skipped = version, 0
+	}
+}
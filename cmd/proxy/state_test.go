@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	before := newRegistry()
+	c := newCoordinator(log.NewNopLogger(), "client", "", newTicket(), 0, before)
+	before.update("client", func(*Coordinator) *Coordinator { return c })
+	c.addScrapeTarget("node", nil)
+	c.addScrapeTarget("app", nil)
+	assert.NoError(t, saveState(path, before.Targets(), time.Now()))
+
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+	assert.NoError(t, s.restoreState(path, time.Minute))
+	tgs := listTargets(ha)
+	if assert.Len(t, tgs, 1) {
+		assert.Equal(t, []string{"app.client:80", "node.client:80"}, tgs[0].Targets)
+		assert.Equal(t, "true", tgs[0].Labels["__meta_pushprox_stale"])
+		assert.Equal(t, "true", tgs[0].Labels["__meta_pushprox_restored"])
+	}
+	restored := s.reg.get("client")
+
+	// the reconnecting client adopts the restored targets and registers them again
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "client", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	assert.True(t, restored == s.reg.get("client"))
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte("node")))
+	for i := 0; i < 100 && restoredTargets(ha) > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// drop the remaining restored target early rather than waiting for the restore period
+	restored.dropRestoredTargets()
+	tgs = listTargets(ha)
+	if assert.Len(t, tgs, 1) {
+		assert.Equal(t, []string{"node.client:80"}, tgs[0].Targets)
+		assert.Equal(t, "false", tgs[0].Labels["__meta_pushprox_stale"])
+	}
+}
+
+func restoredTargets(h http.Handler) int {
+	var n int
+	for _, tg := range listTargets(h) {
+		if tg.Labels["__meta_pushprox_restored"] == "true" {
+			n += len(tg.Targets)
+		}
+	}
+	return n
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stages of a scrape an error is counted by.
+const (
+	stageQueue    = "queue"    // not admitted by a scrape limiter
+	stageTunnel   = "tunnel"   // no scrape connection to the client
+	stageRequest  = "request"  // writing the scrape request to the client
+	stageResponse = "response" // reading the scrape response from the client
+	stageStatus   = "status"   // the client or exporter answered with an error
+)
+
+var (
+	targetScrapesDesc = prometheus.NewDesc(
+		namespace+"_target_scrapes_total",
+		"Scrapes of a target through the proxy.",
+		[]string{"fqdn", "process"}, nil,
+	)
+	targetScrapeErrorsDesc = prometheus.NewDesc(
+		namespace+"_target_scrape_errors_total",
+		"Failed scrapes of a target by the stage they failed in.",
+		[]string{"fqdn", "process", "stage"}, nil,
+	)
+	targetScrapeDurationDesc = prometheus.NewDesc(
+		namespace+"_target_scrape_duration_seconds_total",
+		"Total duration of the scrapes of a target.",
+		[]string{"fqdn", "process"}, nil,
+	)
+	targetLastScrapeDurationDesc = prometheus.NewDesc(
+		namespace+"_target_last_scrape_duration_seconds",
+		"Duration of the last scrape of a target.",
+		[]string{"fqdn", "process"}, nil,
+	)
+	targetResponseSizeDesc = prometheus.NewDesc(
+		namespace+"_target_response_size_bytes_total",
+		"Total size of the scrape responses of a target.",
+		[]string{"fqdn", "process"}, nil,
+	)
+	targetLastSuccessDesc = prometheus.NewDesc(
+		namespace+"_target_last_success_timestamp_seconds",
+		"Timestamp of the last successful scrape of a target.",
+		[]string{"fqdn", "process"}, nil,
+	)
+	targetUpDesc = prometheus.NewDesc(
+		namespace+"_target_up",
+		"Whether the last scrape of a target succeeded.",
+		[]string{"fqdn", "process"}, nil,
+	)
+	targetStatsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: namespace + "_target_stats_dropped_total",
+			Help: "Scrapes not accounted per target as the number of tracked targets reached its limit.",
+		},
+	)
+
+	// targetStats holds the statistics of the scrapes through the proxy
+	targetStats = newScrapeStats()
+)
+
+func init() {
+	prometheus.MustRegister(targetStats, targetStatsDropped)
+}
+
+type statsKey struct {
+	fqdn, process string
+}
+
+// targetStat are the statistics of the scrapes of a target.
+type targetStat struct {
+	Fqdn                string            `json:"fqdn"`
+	Process             string            `json:"process"`
+	Scrapes             uint64            `json:"scrapes"`
+	Errors              map[string]uint64 `json:"errors,omitempty"` // by stage
+	DurationSeconds     float64           `json:"durationSeconds"`
+	LastDurationSeconds float64           `json:"lastDurationSeconds"`
+	ResponseBytes       uint64            `json:"responseBytes"`
+	LastSuccess         *time.Time        `json:"lastSuccess,omitempty"`
+	LastError           string            `json:"lastError,omitempty"`
+	Up                  bool              `json:"up"`
+}
+
+// scrapeStats tracks the statistics of up to --stats.max-targets targets.
+type scrapeStats struct {
+	mu      sync.Mutex
+	targets map[statsKey]*targetStat
+}
+
+func newScrapeStats() *scrapeStats {
+	return &scrapeStats{targets: map[statsKey]*targetStat{}}
+}
+
+// record accounts a scrape of process on fqdn, stage is empty for a successful scrape.
+func (s *scrapeStats) record(fqdn, process string, duration time.Duration, size int64, stage string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := statsKey{fqdn, process}
+	t, ok := s.targets[key]
+	if !ok {
+		if len(s.targets) >= *statsMaxTargets {
+			targetStatsDropped.Inc()
+			return
+		}
+		t = &targetStat{Fqdn: fqdn, Process: process, Errors: map[string]uint64{}}
+		s.targets[key] = t
+	}
+	t.Scrapes++
+	t.DurationSeconds += duration.Seconds()
+	t.LastDurationSeconds = duration.Seconds()
+	t.ResponseBytes += uint64(size)
+	t.Up = stage == ""
+	if t.Up {
+		now := time.Now()
+		t.LastSuccess = &now
+		return
+	}
+	t.Errors[stage]++
+	if err != nil {
+		t.LastError = err.Error()
+	}
+}
+
+// forget drops the statistics of process on fqdn, or of all processes on fqdn if process is empty.
+func (s *scrapeStats) forget(fqdn, process string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.targets {
+		if key.fqdn == fqdn && (process == "" || key.process == process) {
+			delete(s.targets, key)
+		}
+	}
+}
+
+// snapshot returns copies of the statistics sorted by fqdn and process.
+func (s *scrapeStats) snapshot() []*targetStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]*targetStat, 0, len(s.targets))
+	for _, t := range s.targets {
+		c := *t
+		c.Errors = make(map[string]uint64, len(t.Errors))
+		for stage, n := range t.Errors {
+			c.Errors[stage] = n
+		}
+		stats = append(stats, &c)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Fqdn != stats[j].Fqdn {
+			return stats[i].Fqdn < stats[j].Fqdn
+		}
+		return stats[i].Process < stats[j].Process
+	})
+	return stats
+}
+
+// Describe implements prometheus.Collector.
+func (s *scrapeStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- targetScrapesDesc
+	ch <- targetScrapeErrorsDesc
+	ch <- targetScrapeDurationDesc
+	ch <- targetLastScrapeDurationDesc
+	ch <- targetResponseSizeDesc
+	ch <- targetLastSuccessDesc
+	ch <- targetUpDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *scrapeStats) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range s.snapshot() {
+		ch <- prometheus.MustNewConstMetric(targetScrapesDesc, prometheus.CounterValue, float64(t.Scrapes), t.Fqdn, t.Process)
+		for _, stage := range []string{stageQueue, stageTunnel, stageRequest, stageResponse, stageStatus} {
+			ch <- prometheus.MustNewConstMetric(targetScrapeErrorsDesc, prometheus.CounterValue, float64(t.Errors[stage]), t.Fqdn, t.Process, stage)
+		}
+		ch <- prometheus.MustNewConstMetric(targetScrapeDurationDesc, prometheus.CounterValue, t.DurationSeconds, t.Fqdn, t.Process)
+		ch <- prometheus.MustNewConstMetric(targetLastScrapeDurationDesc, prometheus.GaugeValue, t.LastDurationSeconds, t.Fqdn, t.Process)
+		ch <- prometheus.MustNewConstMetric(targetResponseSizeDesc, prometheus.CounterValue, float64(t.ResponseBytes), t.Fqdn, t.Process)
+		if t.LastSuccess != nil {
+			ch <- prometheus.MustNewConstMetric(targetLastSuccessDesc, prometheus.GaugeValue, float64(t.LastSuccess.UnixNano())/1e9, t.Fqdn, t.Process)
+		}
+		if *statsTargetUp {
+			up := 0.0
+			if t.Up {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(targetUpDesc, prometheus.GaugeValue, up, t.Fqdn, t.Process)
+		}
+	}
+}
+
+// handleStats serves the scrape statistics of the targets as JSON.
+func (h *httpHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetStats.snapshot())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus-community/pushprox/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeStats(t *testing.T) {
+	targetStats.forget("stats.example", "")
+	s, ha := newTestServer(t, time.Minute)
+	defer s.l.Close()
+
+	session, ctlConn, _, err := dialTestClient(s.l.Addr().String(), "stats.example", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for _, process := range []string{"node", "broken"} {
+		assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeRegister, []byte(process)))
+	}
+	waitTargets(ha, 2)
+	go serveTestScrapes(session, ctlConn, "stats.example", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Host, "broken.") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "up 1\n")
+	}))
+	for _, path := range []string{"/scrape/stats.example/node", "/scrape/stats.example/node", "/scrape/stats.example/broken", "/scrape/stats.example/unknown"} {
+		ha.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	ha.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	var stats []*targetStat
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&stats))
+	byProcess := map[string]*targetStat{}
+	for _, st := range stats {
+		if st.Fqdn == "stats.example" {
+			byProcess[st.Process] = st
+		}
+	}
+	if !assert.Len(t, byProcess, 2) {
+		return
+	}
+	assert.Equal(t, uint64(2), byProcess["node"].Scrapes)
+	assert.Equal(t, uint64(10), byProcess["node"].ResponseBytes)
+	assert.True(t, byProcess["node"].Up)
+	assert.NotNil(t, byProcess["node"].LastSuccess)
+	assert.Equal(t, map[string]uint64{stageStatus: 1}, byProcess["broken"].Errors)
+	assert.False(t, byProcess["broken"].Up)
+	assert.Nil(t, byProcess["broken"].LastSuccess)
+
+	// the statistics go with the target
+	assert.NoError(t, util.WriteMsg(ctlConn, util.MsgTypeDeregister, []byte("broken")))
+	waitTargets(ha, 1)
+	for _, st := range targetStats.snapshot() {
+		assert.False(t, st.Fqdn == "stats.example" && st.Process == "broken")
+	}
+}
+
+func TestScrapeStatsLimit(t *testing.T) {
+	defer func(max int, up bool) { *statsMaxTargets, *statsTargetUp = max, up }(*statsMaxTargets, *statsTargetUp)
+	*statsMaxTargets, *statsTargetUp = 1, true
+
+	stats := newScrapeStats()
+	dropped := testutil.ToFloat64(targetStatsDropped)
+	stats.record("client", "node", time.Second, 100, "", nil)
+	stats.record("client", "app", time.Second, 0, stageTunnel, errors.New("timeout"))
+	assert.Equal(t, dropped+1, testutil.ToFloat64(targetStatsDropped))
+
+	assert.NoError(t, testutil.CollectAndCompare(stats, strings.NewReader(`
+# HELP pushprox_target_up Whether the last scrape of a target succeeded.
+# TYPE pushprox_target_up gauge
+pushprox_target_up{fqdn="client",process="node"} 1
+# HELP pushprox_target_scrape_errors_total Failed scrapes of a target by the stage they failed in.
+# TYPE pushprox_target_scrape_errors_total counter
+pushprox_target_scrape_errors_total{fqdn="client",process="node",stage="queue"} 0
+pushprox_target_scrape_errors_total{fqdn="client",process="node",stage="request"} 0
+pushprox_target_scrape_errors_total{fqdn="client",process="node",stage="response"} 0
+pushprox_target_scrape_errors_total{fqdn="client",process="node",stage="status"} 0
+pushprox_target_scrape_errors_total{fqdn="client",process="node",stage="tunnel"} 0
+`), "pushprox_target_up", "pushprox_target_scrape_errors_total"))
+
+	stats.forget("client", "")
+	assert.Empty(t, stats.snapshot())
+}
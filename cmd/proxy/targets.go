@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+const metaLabelPrefix = "__meta_pushprox_"
+
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// handleListTargets handles requests to list available targets in the file_sd format,
+// which http_sd_configs consumes as well. The query parameters of targetFilter select
+// a subset of the targets, stale=true includes the stale ones.
+func (h *httpHandler) handleListTargets(w http.ResponseWriter, r *http.Request) {
+	includeStale, _ := strconv.ParseBool(r.URL.Query().Get("stale"))
+	filter, err := parseTargetFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	targets := targetGroups(h.s.reg.Targets(), filter, includeStale, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+	level.Info(h.logger).Log("msg", "Responded to /targets", "target_count", len(targets))
+}
+
+// targetGroups returns the listed targets of known selected by filter, grouped by client.
+// The labels of the file_sd format are per group, so the targets of a client whose labels
+// differ, i.e. by the labels they registered or their scrape settings, are split into
+// groups of their own. The process name is the first label of the target address rather
+// than a label of the group, the last renewal age of a group is that of its oldest target.
+func targetGroups(known []*Target, filter *targetFilter, includeStale bool, now time.Time) []*targetGroup {
+	listed := listedTargets(known, includeStale)
+	targets := make([]*targetGroup, 0, len(listed))
+	groups := map[string]*targetGroup{}
+	renewed := map[*targetGroup]time.Time{}
+	for _, t := range listed {
+		labels := targetLabels(t, now)
+		if filter != nil && !filter.matches(t, labels) {
+			continue
+		}
+		delete(labels, metaLabelPrefix+"process")
+		delete(labels, metaLabelPrefix+"last_renewal_age_seconds")
+		key := toLabelSet(labels).String()
+		tg, ok := groups[key]
+		if !ok {
+			tg = &targetGroup{Labels: labels}
+			groups[key] = tg
+			targets = append(targets, tg)
+		}
+		tg.Targets = append(tg.Targets, t.Address())
+		if last, ok := renewed[tg]; !ok || t.LastRenewal.Before(last) {
+			renewed[tg] = t.LastRenewal
+		}
+	}
+	for tg, last := range renewed {
+		tg.Labels[metaLabelPrefix+"last_renewal_age_seconds"] = strconv.Itoa(int(now.Sub(last).Seconds()))
+	}
+	return targets
+}
+
+// listedTargets sorts known by fqdn and process and leaves out the targets whose lease
+// lapsed unless includeStale is set. Those restored from the persisted state are kept.
+func listedTargets(known []*Target, includeStale bool) []*Target {
+	sort.Slice(known, func(i, j int) bool {
+		if known[i].Fqdn != known[j].Fqdn {
+			return known[i].Fqdn < known[j].Fqdn
+		}
+		return known[i].Process < known[j].Process
+	})
+	listed := known[:0]
+	for _, t := range known {
+		if !t.Stale || t.Restored || includeStale {
+			listed = append(listed, t)
+		}
+	}
+	return listed
+}
+
+// targetLabels returns the meta labels of t. The labels registered by the client are
+// exposed as __meta_pushprox_label_<name>, except for the scrape settings.
+func targetLabels(t *Target, now time.Time) map[string]string {
+	labels := map[string]string{
+		metaLabelPrefix + "fqdn":                     t.Fqdn,
+		metaLabelPrefix + "process":                  t.Process,
+		metaLabelPrefix + "stale":                    strconv.FormatBool(t.Stale),
+		metaLabelPrefix + "last_renewal_age_seconds": strconv.Itoa(int(now.Sub(t.LastRenewal).Seconds())),
+	}
+	if t.Restored {
+		labels[metaLabelPrefix+"restored"] = "true"
+	}
+	if t.Client.RemoteAddr != "" {
+		labels[metaLabelPrefix+"client_address"] = t.Client.RemoteAddr
+	}
+	if t.Client.TokenID != "" {
+		labels[metaLabelPrefix+"token_id"] = t.Client.TokenID
+	}
+	if t.Client.Version != "" {
+		labels[metaLabelPrefix+"client_version"] = t.Client.Version
+	}
+	if !t.Client.ConnectedAt.IsZero() {
+		labels[metaLabelPrefix+"connected_at"] = t.Client.ConnectedAt.UTC().Format(time.RFC3339)
+	}
+	for name, value := range t.Labels {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		labels[metaLabelPrefix+"label_"+sanitizeLabelName(name)] = value
+	}
+	// the metrics path isn't, it would override the metrics_path of the job
+	if v := setting(t, metricsPathLabel); v != "" {
+		labels[metaLabelPrefix+"metrics_path"] = v
+	}
+	// the scrape settings registered for the process are taken by Prometheus as is
+	for _, name := range []string{jobLabel, scrapeIntervalLabel, scrapeTimeoutLabel} {
+		if v := setting(t, name); v != "" {
+			labels[name] = v
+		}
+	}
+	return labels
+}
+
+// sanitizeLabelName replaces all characters not valid in a Prometheus label name with underscores.
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// targetFilter selects targets by the query parameters of /targets:
+//
+//	fqdn     glob of the fqdn, i.e edge-*.example.com
+//	process  name of the process, may be repeated
+//	token    token id of the client, see util.TokenID
+//	tenant   value of the "tenant" label registered by the client
+//	match[]  PromQL selector on the labels registered by the client and the meta labels,
+//	         may be repeated to select the targets matching any of them
+//	shard, of  hashmod of the target address, selects the shard-th of n disjoint slices
+type targetFilter struct {
+	fqdn      string
+	processes map[string]bool
+	tokenID   string
+	tenant    string
+	selectors [][]*labelMatcher
+	shard, of uint64
+}
+
+func parseTargetFilter(q url.Values) (*targetFilter, error) {
+	f := &targetFilter{
+		fqdn:    q.Get("fqdn"),
+		tokenID: q.Get("token"),
+		tenant:  q.Get("tenant"),
+	}
+	if _, err := path.Match(f.fqdn, ""); err != nil {
+		return nil, fmt.Errorf("bad fqdn glob %q: %v", f.fqdn, err)
+	}
+	if ps := q["process"]; len(ps) > 0 {
+		f.processes = map[string]bool{}
+		for _, p := range ps {
+			f.processes[p] = true
+		}
+	}
+	for _, sel := range q["match[]"] {
+		matchers, err := parseSelector(sel)
+		if err != nil {
+			return nil, err
+		}
+		f.selectors = append(f.selectors, matchers)
+	}
+	shard, of := q.Get("shard"), q.Get("of")
+	if shard != "" || of != "" {
+		var err error
+		if f.of, err = strconv.ParseUint(of, 10, 64); err != nil || f.of == 0 {
+			return nil, fmt.Errorf("bad shard count %q", of)
+		}
+		if f.shard, err = strconv.ParseUint(shard, 10, 64); err != nil || f.shard >= f.of {
+			return nil, fmt.Errorf("bad shard %q of %d", shard, f.of)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether t with the meta labels labels is selected by f.
+func (f *targetFilter) matches(t *Target, labels map[string]string) bool {
+	if f.fqdn != "" {
+		if ok, _ := path.Match(f.fqdn, t.Fqdn); !ok {
+			return false
+		}
+	}
+	if f.processes != nil && !f.processes[t.Process] {
+		return false
+	}
+	if f.tokenID != "" && f.tokenID != t.Client.TokenID {
+		return false
+	}
+	if f.tenant != "" && f.tenant != t.Labels["tenant"] {
+		return false
+	}
+	if f.of > 0 && hashmod(t.Address(), f.of) != f.shard {
+		return false
+	}
+	if len(f.selectors) == 0 {
+		return true
+	}
+	all := make(map[string]string, len(t.Labels)+len(labels)+1)
+	for k, v := range t.Labels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	all["__address__"] = t.Address()
+	for _, matchers := range f.selectors {
+		if matchAll(matchers, all) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAll(matchers []*labelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// hashmod hashes s like the hashmod action of Prometheus relabeling.
+func hashmod(s string, mod uint64) uint64 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[8:]) % mod
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetFilter(t *testing.T) {
+	targets := []*Target{
+		{Fqdn: "edge-1.example.com", Process: "node", Labels: map[string]string{"tenant": "a", "team": "infra"}, Client: clientInfo{TokenID: "t1"}},
+		{Fqdn: "edge-1.example.com", Process: "app", Labels: map[string]string{"tenant": "a"}, Client: clientInfo{TokenID: "t1"}},
+		{Fqdn: "core-1.example.com", Process: "node", Labels: map[string]string{"tenant": "b", "team": "db"}, Client: clientInfo{TokenID: "t2"}},
+	}
+	selected := func(query string) []string {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parseTargetFilter(q)
+		if !assert.NoError(t, err, query) {
+			return nil
+		}
+		var addrs []string
+		for _, tg := range targets {
+			if f.matches(tg, targetLabels(tg, time.Now())) {
+				addrs = append(addrs, tg.Address())
+			}
+		}
+		return addrs
+	}
+
+	assert.Len(t, selected(""), 3)
+	assert.Equal(t, []string{"node.edge-1.example.com:80", "app.edge-1.example.com:80"}, selected("fqdn=edge-*"))
+	assert.Equal(t, []string{"node.edge-1.example.com:80", "node.core-1.example.com:80"}, selected("process=node"))
+	assert.Len(t, selected("process=node&process=app"), 3)
+	assert.Equal(t, []string{"node.core-1.example.com:80"}, selected("token=t2"))
+	assert.Equal(t, []string{"node.core-1.example.com:80"}, selected("tenant=b"))
+	assert.Equal(t, []string{"node.edge-1.example.com:80"}, selected(url.Values{"match[]": {`{team="infra"}`}}.Encode()))
+	assert.Len(t, selected(url.Values{"match[]": {`{team="infra"}`, `{__meta_pushprox_fqdn=~"core-.*"}`}}.Encode()), 2)
+	assert.Empty(t, selected(url.Values{"fqdn": {"core-*"}, "match[]": {`{team="infra"}`}}.Encode()))
+
+	// shards are disjoint and cover all targets
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		for _, addr := range selected(fmt.Sprintf("shard=%d&of=4", i)) {
+			seen[addr]++
+		}
+	}
+	assert.Len(t, seen, 3)
+	for addr, n := range seen {
+		assert.Equal(t, 1, n, addr)
+	}
+
+	for _, bad := range []string{"fqdn=[", "shard=4&of=4", "shard=1", "of=0", "shard=x&of=2", "match[]=team"} {
+		q, _ := url.ParseQuery(bad)
+		_, err := parseTargetFilter(q)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestTargetGroups(t *testing.T) {
+	now := time.Now()
+	tgs := targetGroups([]*Target{
+		{Fqdn: "edge-1.example.com", Process: "node", LastRenewal: now.Add(-5 * time.Second)},
+		{Fqdn: "edge-1.example.com", Process: "app", LastRenewal: now.Add(-30 * time.Second)},
+		{Fqdn: "edge-1.example.com", Process: "jmx", Labels: map[string]string{"job": "jmx"}, LastRenewal: now},
+		{Fqdn: "core-1.example.com", Process: "node", LastRenewal: now},
+	}, nil, false, now)
+	if !assert.Len(t, tgs, 3) {
+		return
+	}
+	assert.Equal(t, []string{"node.core-1.example.com:80"}, tgs[0].Targets)
+	assert.Equal(t, []string{"app.edge-1.example.com:80", "node.edge-1.example.com:80"}, tgs[1].Targets)
+	assert.Equal(t, "30", tgs[1].Labels["__meta_pushprox_last_renewal_age_seconds"])
+	assert.Equal(t, []string{"jmx.edge-1.example.com:80"}, tgs[2].Targets)
+	assert.Equal(t, "jmx", tgs[2].Labels["job"])
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 )
@@ -13,3 +14,9 @@ func SignAuth(token string, timestamp int64) (key string) {
 	data := hash.Sum(nil)
 	return hex.EncodeToString(data)
 }
+
+// TokenID returns a short identifier of token that is safe to expose.
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of scrape bodies in the tunnel.
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// TunnelEncodingHeader names the compression of a scrape body in the tunnel, it's removed by the proxy.
+const TunnelEncodingHeader = "X-Pushprox-Tunnel-Encoding"
+
+// ParseCompressions parses a comma separated list of compressions in order of preference.
+func ParseCompressions(s string) ([]string, error) {
+	var compressions []string
+	for _, c := range strings.Split(s, ",") {
+		switch c = strings.TrimSpace(c); c {
+		case "", "none":
+		case CompressionZstd, CompressionGzip:
+			compressions = append(compressions, c)
+		default:
+			return nil, fmt.Errorf("unknown compression %q", c)
+		}
+	}
+	return compressions, nil
+}
+
+// NegotiateCompression returns the first of offered that is supported, or "" if none is.
+func NegotiateCompression(offered, supported []string) string {
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+// NewDecompressReader returns a reader decompressing r.
+func NewDecompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
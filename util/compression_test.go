@@ -0,0 +1,48 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	compressions, err := ParseCompressions(" zstd, gzip ")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{CompressionZstd, CompressionGzip}, compressions)
+	compressions, err = ParseCompressions("none")
+	assert.NoError(t, err)
+	assert.Empty(t, compressions)
+	_, err = ParseCompressions("brotli")
+	assert.Error(t, err)
+
+	assert.Equal(t, CompressionGzip, NegotiateCompression([]string{"brotli", CompressionGzip, CompressionZstd}, []string{CompressionZstd, CompressionGzip}))
+	assert.Equal(t, "", NegotiateCompression([]string{CompressionZstd}, nil))
+	assert.Equal(t, "", NegotiateCompression(nil, []string{CompressionZstd}))
+
+	text := strings.Repeat("http_requests_total{code=\"200\"} 1027\n", 100)
+	for _, compression := range []string{CompressionZstd, CompressionGzip} {
+		var buf bytes.Buffer
+		var w io.WriteCloser = gzip.NewWriter(&buf)
+		if compression == CompressionZstd {
+			w, err = zstd.NewWriter(&buf)
+			assert.NoError(t, err)
+		}
+		w.Write([]byte(text))
+		assert.NoError(t, w.Close())
+		assert.Less(t, buf.Len(), len(text)/10, compression)
+
+		r, err := NewDecompressReader(&buf, compression)
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, text, string(b), compression)
+		r.Close()
+	}
+}
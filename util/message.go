@@ -16,6 +16,7 @@ const (
 
 	MsgTypeRegister   MsgType = "register"
 	MsgTypeDeregister MsgType = "deregister"
+	MsgTypeRenew      MsgType = "renew"
 
 	MsgTypeReqScrapeConn MsgType = "reqScrapeConn"
 	MsgTypeNewScrapeConn MsgType = "newScrapeConn"
@@ -39,6 +40,7 @@ func init() {
 		'o': MsgTypeNewMachineOK,
 		'r': MsgTypeRegister,
 		'd': MsgTypeDeregister,
+		'l': MsgTypeRenew,
 		's': MsgTypeReqScrapeConn,
 		'c': MsgTypeNewScrapeConn,
 	}
@@ -47,6 +49,7 @@ func init() {
 		MsgTypeNewMachineOK:  'o',
 		MsgTypeRegister:      'r',
 		MsgTypeDeregister:    'd',
+		MsgTypeRenew:         'l',
 		MsgTypeReqScrapeConn: 's',
 		MsgTypeNewScrapeConn: 'c',
 	}
@@ -106,6 +109,14 @@ type NewClientMessage struct {
 	Fqdn      string `json:"fqdn"`
 	Timestamp int64  `json:"timestamp"`
 	Auth      string `json:"auth"`
+	// Ticket is the resumption ticket issued by the proxy at the last handshake, if any
+	Ticket string `json:"ticket,omitempty"`
+	// Leases tells the proxy the client renews its registrations with MsgTypeRenew
+	Leases bool `json:"leases,omitempty"`
+	// Version is the version of the client
+	Version string `json:"version,omitempty"`
+	// Compressions are the compressions of scrape bodies in the tunnel the client offers, in order of preference
+	Compressions []string `json:"compressions,omitempty"`
 }
 
 func (m *NewClientMessage) Marshal() ([]byte, error) {
@@ -117,3 +128,49 @@ func UnmarshalIntoNewClientMessage(data []byte) (*NewClientMessage, error) {
 	err := json.Unmarshal(data, &m)
 	return &m, err
 }
+
+// NewMachineOKMessage is the proxy's answer to a successful MsgTypeNewMachine.
+// Proxies before session resumption send it empty.
+type NewMachineOKMessage struct {
+	// Ticket allows the client to reattach to its targets after a reconnect
+	Ticket string `json:"ticket,omitempty"`
+	// LeaseTTLSeconds is how long a registration lives unless renewed, 0 if leases are off
+	LeaseTTLSeconds int64 `json:"leaseTTLSeconds,omitempty"`
+	// RegisterMetadata tells the client to send registrations as RegisterMessage
+	RegisterMetadata bool `json:"registerMetadata,omitempty"`
+	// Compression is the compression of scrape bodies in the tunnel picked from the offered ones, if any
+	Compression string `json:"compression,omitempty"`
+}
+
+func (m *NewMachineOKMessage) Marshal() ([]byte, error) {
+	return json.Marshal(&m)
+}
+
+func UnmarshalIntoNewMachineOKMessage(data []byte) (*NewMachineOKMessage, error) {
+	var m NewMachineOKMessage
+	if len(data) == 0 {
+		return &m, nil
+	}
+	err := json.Unmarshal(data, &m)
+	return &m, err
+}
+
+// RegisterMessage is the payload of MsgTypeRegister and MsgTypeRenew sent to proxies announcing
+// RegisterMetadata. Older clients send the bare process name instead.
+type RegisterMessage struct {
+	Process string            `json:"process"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func (m *RegisterMessage) Marshal() ([]byte, error) {
+	return json.Marshal(&m)
+}
+
+func UnmarshalIntoRegisterMessage(data []byte) (*RegisterMessage, error) {
+	if len(data) == 0 || data[0] != '{' {
+		return &RegisterMessage{Process: string(data)}, nil
+	}
+	var m RegisterMessage
+	err := json.Unmarshal(data, &m)
+	return &m, err
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// MuxConfig holds the tunable parameters of the yamux session between proxy and client.
+type MuxConfig struct {
+	// AcceptBacklog limits how many streams may be waiting an accept.
+	AcceptBacklog int `yaml:"accept-backlog,omitempty"`
+	// DisableKeepAlive turns off the periodic keepalive pings.
+	DisableKeepAlive bool `yaml:"disable-keepalive,omitempty"`
+	// KeepAliveInterval is how often a keepalive ping is sent.
+	KeepAliveInterval time.Duration `yaml:"keepalive-interval,omitempty"`
+	// WriteTimeout is the time after which a blocked write closes the session.
+	WriteTimeout time.Duration `yaml:"write-timeout,omitempty"`
+	// MaxStreamWindowSize is the maximum receive window of a stream in bytes, at least 256KiB.
+	MaxStreamWindowSize uint32 `yaml:"max-stream-window-size,omitempty"`
+	// StreamOpenTimeout is how long an opened stream waits for an ack from the peer.
+	StreamOpenTimeout time.Duration `yaml:"stream-open-timeout,omitempty"`
+	// StreamCloseTimeout is how long a half-closed stream waits before being reset.
+	StreamCloseTimeout time.Duration `yaml:"stream-close-timeout,omitempty"`
+}
+
+// AddMuxFlags adds the flags used by MuxConfig to a kingpin application.
+func AddMuxFlags(a *kingpin.Application, c *MuxConfig) {
+	a.Flag("mux.accept-backlog", "Number of streams that may be waiting an accept.").
+		Default("256").IntVar(&c.AcceptBacklog)
+	a.Flag("mux.disable-keepalive", "Disable keepalive pings on the tunnel.").
+		BoolVar(&c.DisableKeepAlive)
+	a.Flag("mux.keepalive-interval", "Interval of keepalive pings on the tunnel.").
+		Default("30s").DurationVar(&c.KeepAliveInterval)
+	a.Flag("mux.write-timeout", "Close the tunnel if a write blocks longer than this.").
+		Default("10s").DurationVar(&c.WriteTimeout)
+	a.Flag("mux.max-stream-window-size", "Maximum receive window of a tunnel stream in bytes, raise it for links with high bandwidth-delay product.").
+		Default("262144").Uint32Var(&c.MaxStreamWindowSize)
+	a.Flag("mux.stream-open-timeout", "Maximum time an opened stream waits for an ack from the peer.").
+		Default("75s").DurationVar(&c.StreamOpenTimeout)
+	a.Flag("mux.stream-close-timeout", "Maximum time a half-closed stream waits before being reset.").
+		Default("5m").DurationVar(&c.StreamCloseTimeout)
+}
+
+// YamuxConfig converts c into a verified yamux.Config.
+func (c *MuxConfig) YamuxConfig() (*yamux.Config, error) {
+	cfg := yamux.DefaultConfig()
+	if c.AcceptBacklog != 0 {
+		cfg.AcceptBacklog = c.AcceptBacklog
+	}
+	cfg.EnableKeepAlive = !c.DisableKeepAlive
+	if c.KeepAliveInterval != 0 {
+		cfg.KeepAliveInterval = c.KeepAliveInterval
+	}
+	if c.WriteTimeout != 0 {
+		cfg.ConnectionWriteTimeout = c.WriteTimeout
+	}
+	if c.MaxStreamWindowSize != 0 {
+		cfg.MaxStreamWindowSize = c.MaxStreamWindowSize
+	}
+	if c.StreamOpenTimeout != 0 {
+		cfg.StreamOpenTimeout = c.StreamOpenTimeout
+	}
+	if c.StreamCloseTimeout != 0 {
+		cfg.StreamCloseTimeout = c.StreamCloseTimeout
+	}
+	return cfg, yamux.VerifyConfig(cfg)
+}
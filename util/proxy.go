@@ -39,3 +39,17 @@ func GetHeaderTimeout(h http.Header) (time.Duration, error) {
 
 	return time.Duration(timeoutSeconds * 1e9), nil
 }
+
+// GetScrapeTimeout returns the timeout of a scrape given its headers, falling back to
+// defaultScrapeTimeout and clamping to maxScrapeTimeout.
+func GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout *time.Duration, h http.Header) time.Duration {
+	timeout := *defaultScrapeTimeout
+	headerTimeout, err := GetHeaderTimeout(h)
+	if err == nil {
+		timeout = headerTimeout
+	}
+	if timeout > *maxScrapeTimeout {
+		timeout = *maxScrapeTimeout
+	}
+	return timeout
+}